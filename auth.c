@@ -0,0 +1,264 @@
+/* Copyright 2026 Google LLC
+ *
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file or at
+ * https://developers.google.com/open-source/licenses/bsd */
+
+#include "auth.h"
+
+#include <arpa/inet.h>
+#include <crypt.h>
+#include <stdlib.h>
+#include <string.h>
+#include <openssl/crypto.h>
+#include <openssl/evp.h>
+
+#define MD5SZ 16
+
+static const char itoa64[] =
+	"./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz";
+
+static char *to64(char *o, unsigned long v, int n)
+{
+	while (n--) { *o++ = itoa64[v & 0x3f]; v >>= 6; }
+	return o;
+}
+
+static int md5up(EVP_MD_CTX *c, const void *b, size_t sz)
+{
+	return EVP_DigestUpdate(c, b, sz);
+}
+
+/* Hashes pw using the salt in an Apache MD5 hash, which starts with "$apr1$",
+   and writes the complete hash to out. Returns 0 on failure. */
+static int apr1(const char *pw, const char *hash, char out[64])
+{
+	const char *magic = "$apr1$", *salt = hash + strlen(magic);
+	size_t pwl = strlen(pw), sl = strcspn(salt, "$");
+	unsigned char fin[EVP_MAX_MD_SIZE];
+	unsigned finl;
+	int i, ok = 0;
+	char *o;
+	EVP_MD_CTX *c = EVP_MD_CTX_create(), *c1 = EVP_MD_CTX_create();
+
+	if (sl > 8) sl = 8;
+	if (!c || !c1) goto cleanup;
+
+	if (!EVP_DigestInit_ex(c1, EVP_md5(), 0))		goto cleanup;
+	if (!md5up(c1, pw, pwl) || !md5up(c1, salt, sl))	goto cleanup;
+	if (!md5up(c1, pw, pwl))				goto cleanup;
+	if (!EVP_DigestFinal_ex(c1, fin, &finl))		goto cleanup;
+
+	if (!EVP_DigestInit_ex(c, EVP_md5(), 0))		goto cleanup;
+	if (!md5up(c, pw, pwl) || !md5up(c, magic, strlen(magic)))
+								goto cleanup;
+	if (!md5up(c, salt, sl))				goto cleanup;
+	for (i = pwl; i > 0; i -= MD5SZ)
+		if (!md5up(c, fin, i > MD5SZ ? MD5SZ : i))	goto cleanup;
+
+	for (i = pwl; i; i >>= 1)
+		if (!md5up(c, i & 1 ? "" : pw, 1))		goto cleanup;
+	if (!EVP_DigestFinal_ex(c, fin, &finl))			goto cleanup;
+
+	/* Stretch it, as in FreeBSD's md5crypt. */
+	for (i = 0; i < 1000; i++) {
+		if (!EVP_DigestInit_ex(c1, EVP_md5(), 0))	goto cleanup;
+		if (i & 1)	{ if (!md5up(c1, pw, pwl))	goto cleanup; }
+		else		{ if (!md5up(c1, fin, MD5SZ))	goto cleanup; }
+		if (i % 3 && !md5up(c1, salt, sl))		goto cleanup;
+		if (i % 7 && !md5up(c1, pw, pwl))		goto cleanup;
+		if (i & 1)	{ if (!md5up(c1, fin, MD5SZ))	goto cleanup; }
+		else		{ if (!md5up(c1, pw, pwl))	goto cleanup; }
+		if (!EVP_DigestFinal_ex(c1, fin, &finl))	goto cleanup;
+	}
+
+	o = out + sprintf(out, "%s%.*s$", magic, (int) sl, salt);
+	o = to64(o, (fin[0] << 16) | (fin[6] << 8) | fin[12], 4);
+	o = to64(o, (fin[1] << 16) | (fin[7] << 8) | fin[13], 4);
+	o = to64(o, (fin[2] << 16) | (fin[8] << 8) | fin[14], 4);
+	o = to64(o, (fin[3] << 16) | (fin[9] << 8) | fin[15], 4);
+	o = to64(o, (fin[4] << 16) | (fin[10] << 8) | fin[5], 4);
+	o = to64(o, fin[11], 2);
+	*o = 0;
+	ok = 1;
+
+cleanup:
+	if (c)	EVP_MD_CTX_destroy(c);
+	if (c1)	EVP_MD_CTX_destroy(c1);
+	return ok;
+}
+
+/* Writes "{SHA}" and the base64-encoded SHA-1 hash of pw to out. */
+static int sha(const char *pw, char out[64])
+{
+	unsigned char md[EVP_MAX_MD_SIZE];
+	unsigned mdl;
+
+	if (!EVP_Digest(pw, strlen(pw), md, &mdl, EVP_sha1(), 0)) return 0;
+
+	strcpy(out, "{SHA}");
+	EVP_EncodeBlock((unsigned char *) out + 5, md, mdl);
+	return 1;
+}
+
+/* Returns whether pw matches a hash from an htpasswd file. */
+static int pwmatches(const char *pw, const char *hash)
+{
+	char buf[64];
+	const char *cand;
+	size_t hl = strlen(hash);
+
+	if (!strncmp(hash, "$apr1$", 6))	cand = apr1(pw, hash, buf) ? buf : 0;
+	else if (!strncmp(hash, "{SHA}", 5))	cand = sha(pw, buf) ? buf : 0;
+	else					cand = crypt(pw, hash);
+
+	return cand && strlen(cand) == hl && !CRYPTO_memcmp(cand, hash, hl);
+}
+
+int htpasswd_ok(FILE *f, const char *user, const char *pw)
+{
+	char ln[512];
+	size_t ul = strlen(user);
+
+	while (fgets(ln, sizeof(ln), f)) {
+		ln[strcspn(ln, "\r\n")] = 0;
+		if (strncmp(ln, user, ul) || ln[ul] != ':') continue;
+
+		return pwmatches(pw, ln + ul + 1);
+	}
+
+	return 0;
+}
+
+/* Parses an IPv4 or IPv6 address into out, and returns its length in bits, or
+   0 if it is not valid. IPv4-mapped IPv6 addresses are treated as IPv4. */
+static int parseaddr(const char *s, unsigned char out[16])
+{
+	if (1 == inet_pton(AF_INET, s, out)) return 32;
+	if (1 != inet_pton(AF_INET6, s, out)) return 0;
+
+	if (!IN6_IS_ADDR_V4MAPPED((struct in6_addr *) out)) return 128;
+	memmove(out, out + 12, 4);
+	return 32;
+}
+
+/* Parses the next entry in a comma-separated list of CIDRs and moves *cidrs past
+   it. Returns the length of the network address in bits, or 0 if the entry is
+   not valid. */
+static int nextcidr(const char **cidrs, unsigned char net[16], int *pref)
+{
+	char ent[64], *slash, *end;
+	size_t el = strcspn(*cidrs, ",");
+	int nbits = 0;
+
+	if (el < sizeof(ent)) {
+		memcpy(ent, *cidrs, el);
+		ent[el] = 0;
+
+		if ((slash = strchr(ent, '/'))) *slash++ = 0;
+		nbits = parseaddr(ent, net);
+		*pref = nbits;
+		if (slash) *pref = strtol(slash, &end, 10);
+		if (slash && (!*slash || *end)) nbits = 0;
+		if (*pref < 0 || *pref > nbits) nbits = 0;
+	}
+
+	*cidrs += el + !!(*cidrs)[el];
+	return nbits;
+}
+
+int addrinlist(const char *cidrs, const char *addr)
+{
+	unsigned char a[16], net[16];
+	int bits, pref, i;
+
+	if (!(bits = parseaddr(addr, a))) return 0;
+
+	while (*cidrs) {
+		if (bits != nextcidr(&cidrs, net, &pref)) continue;
+
+		for (i = 0; pref >= 8; i++, pref -= 8)
+			if (a[i] != net[i]) break;
+		if (pref >= 8) continue;
+		if (pref && (a[i] ^ net[i]) >> (8 - pref)) continue;
+
+		return 1;
+	}
+
+	return 0;
+}
+
+int cidrsvalid(const char *cidrs)
+{
+	unsigned char net[16];
+	int pref;
+
+	while (*cidrs)
+		if (!nextcidr(&cidrs, net, &pref)) return 0;
+	return 1;
+}
+
+static void testhtpasswd(FILE *f, const char *user, const char *pw)
+{
+	rewind(f);
+	printf("%s:%s -> %d\n", user, pw, htpasswd_ok(f, user, pw));
+}
+
+static void testaddr(const char *cidrs, const char *addr)
+{
+	printf("%s in %s -> %d\n", addr, cidrs, addrinlist(cidrs, addr));
+}
+
+void test_auth(void)
+{
+	FILE *f = tmpfile();
+
+	puts("HTPASSWD");
+	fputs(	"# comment\n"
+		"md5:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\r\n"
+		"sha512:$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0"
+			"U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1\n"
+		"bad:notahash\n", f);
+
+	testhtpasswd(f, "md5", "secret");
+	testhtpasswd(f, "md5", "secreT");
+	testhtpasswd(f, "sha", "secret");
+	testhtpasswd(f, "sha", "");
+	testhtpasswd(f, "sha512", "secret");
+	testhtpasswd(f, "sha512", "secret2");
+	testhtpasswd(f, "bad", "notahash");
+	testhtpasswd(f, "nobody", "secret");
+	testhtpasswd(f, "md", "secret");
+	testhtpasswd(f, "# comment", "");
+
+	fclose(f);
+
+	puts("ADDRESS LISTS");
+	testaddr("10.0.0.0/8", "10.1.2.3");
+	testaddr("10.0.0.0/8", "11.1.2.3");
+	testaddr("192.168.1.0/23", "192.168.0.77");
+	testaddr("192.168.1.0/23", "192.168.2.1");
+	testaddr("1.2.3.4,5.6.7.8", "5.6.7.8");
+	testaddr("1.2.3.4,5.6.7.8", "5.6.7.9");
+	testaddr("0.0.0.0/0", "203.0.113.9");
+	testaddr("127.0.0.1", "::ffff:127.0.0.1");
+	testaddr("::1", "::1");
+	testaddr("::1", "127.0.0.1");
+	testaddr("2001:db8::/32", "2001:db8:1::5");
+	testaddr("2001:db8::/33", "2001:db8:8000::5");
+	testaddr("10.0.0.0/33,junk,", "10.0.0.1");
+	testaddr("10.0.0.0/8", "local");
+	testaddr("", "10.0.0.1");
+	testaddr("10.0.0.0/x", "10.0.0.1");
+	testaddr("10.0.0.0/", "10.0.0.1");
+	testaddr("10.0.0.0/8junk", "10.0.0.1");
+
+	puts("VALID ADDRESS LISTS");
+	printf("%d\n", cidrsvalid("10.0.0.0/8,::1,2001:db8::/32"));
+	printf("%d\n", cidrsvalid(""));
+	printf("%d\n", cidrsvalid("10.0.0.0/8,"));
+	printf("%d\n", cidrsvalid("10.0.0.0/8,,::1"));
+	printf("%d\n", cidrsvalid("10.0.0.0/33"));
+	printf("%d\n", cidrsvalid("localhost"));
+}
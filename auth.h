@@ -0,0 +1,23 @@
+/* Copyright 2026 Google LLC
+ *
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file or at
+ * https://developers.google.com/open-source/licenses/bsd */
+
+#include <stdio.h>
+
+/* Returns whether user and pw match an entry in an htpasswd file. Passwords
+   hashed with bcrypt, Apache MD5 ($apr1$), SHA-1 ({SHA}), and any other format
+   understood by crypt(3) are supported. */
+int htpasswd_ok(FILE *f, const char *user, const char *pw);
+
+/* Returns whether addr, an IPv4 or IPv6 address, is in any of the networks in
+   cidrs, which is a comma-separated list like "10.0.0.0/8,::1". */
+int addrinlist(const char *cidrs, const char *addr);
+
+/* Returns whether every entry in a comma-separated list of CIDRs is valid. */
+int cidrsvalid(const char *cidrs);
+
+/* Exercises auth functionality and writes test output to stdout, to be compared
+   with golden test data. */
+void test_auth(void);
@@ -17,6 +17,11 @@ struct subproc_args;
 typedef struct dtach_ctx {
 	struct client *cls;
 	char *sockpath;
+
+	/* A file which exists while a persistent session is running, and is
+	   removed when it ends normally, or null. Sockets are not used for
+	   this, since older versions left them behind after a normal end. */
+	char *runmark;
 	struct subproc_args *spargs;
 
 	struct pty the_pty;
@@ -27,6 +32,39 @@ typedef struct dtach_ctx {
 	/* Indicates the controlled process should be killed as soon as the
 	   connection is terminated. */
 	unsigned isephem	: 1;
+
+	/* Indicates output should still be relayed to a client after it closes
+	   its side of the connection, until the session ends. */
+	unsigned draincli	: 1;
+
+	/* Indicates the previous session with the same ID was lost without
+	   ending normally, e.g. it was killed or the host crashed, since its
+	   runmark was left behind. */
+	unsigned lostprev	: 1;
+
+	/* Indicates the client only observes an existing session, which is not
+	   created if it is not running. */
+	unsigned observe	: 1;
+
+	/* Seconds to wait for the controlled process to exit after it closes the
+	   terminal, before the session ends anyway. */
+	int exitwait;
+
+	/* When the session started. */
+	time_t started;
+
+	/* When the controlled process last wrote output, or 0 if it has not. */
+	time_t lastout;
+
+	/* When a client last sent input or last stopped watching output. */
+	time_t lastin, lastatch;
+
+	/* Seconds a session may go without an attached client, or without
+	   input or output, before it is ended. 0 means no limit. */
+	int detachtmo, idletmo;
+
+	/* The REMOTE_USER who started the session, or null if there was none. */
+	const char *owner;
 } *Dtachctx;
 
 /* Prints attached client information as a Javascript value. It is an array of
@@ -35,4 +73,7 @@ typedef struct dtach_ctx {
    array. */
 void print_atch_clis(Dtachctx dc, struct fdbuf *b);
 
+/* Returns whether any client is receiving terminal output. */
+int has_atch_clis(Dtachctx dc);
+
 #endif
@@ -4,6 +4,7 @@
  * license that can be found in the LICENSE file or at
  * https://developers.google.com/open-source/licenses/bsd */
 
+#include "auth.h"
 #include "http.h"
 #include "outstreams.h"
 #include "shared.h"
@@ -12,18 +13,32 @@
 #include <fcntl.h>
 #include <stdlib.h>
 #include <string.h>
+#include <strings.h>
+#include <unistd.h>
 #include <stdio.h>
 #include <openssl/pem.h>
 #include <openssl/sha.h>
 #include <openssl/evp.h>
 #include <openssl/err.h>
+#include <openssl/crypto.h>
 
 static char reqln[512], *reqcr;
 static unsigned llen;
 
+/* user:password from the Authorization header, or a bearer token */
+static char authcred[384], bearer[256];
+
+/* Client addresses given by a proxy, and whether X-Forwarded-For was too long
+   to keep. */
+static char fwdfor[512], realip[64];
+static int fwdlong;
+
+/* Status code of the last response header written. */
+static int lastcode;
+
 static int readreqln(FILE *f)
 {
-	fgets(reqln, sizeof(reqln), f);
+	if (!fgets(reqln, sizeof(reqln), f)) *reqln = 0;
 	llen = strnlen(reqln, sizeof(reqln));
 	if (llen == sizeof(reqln) || llen < 2) return 0;
 
@@ -38,6 +53,30 @@ static void lcase(char *c) { if (*c >= 'A' && *c <= 'Z') *c |= 0x20; }
 
 static int isws(char c) { return c==9 || c==0xa || c==0xc || c==0xd || c==0x20; }
 
+/* Appends the header in reqln to the CGI-style environment in b. Like CGI
+   servers, leaves out Proxy, which would become HTTP_PROXY and send the
+   hook's own HTTP requests through a proxy of the client's choice, and
+   Authorization, whose credentials are checked before the hook runs. */
+static void hdrtoenv(struct fdbuf *b)
+{
+	char *c = reqln, *val = strchr(reqln, ':');
+
+	if (!val) return;
+	if (!strncmp(reqln, "proxy:", 6)) return;
+	if (!strncmp(reqln, "authorization:", 14)) return;
+
+	fdb_apnd(b, "HTTP_", -1);
+	for (; c < val; c++) {
+		if (*c == '-')			fdb_apnc(b, '_');
+		else if (*c >= 'a' && *c <= 'z')	fdb_apnc(b, *c - 0x20);
+		else					fdb_apnc(b, *c);
+	}
+	fdb_apnc(b, '=');
+	for (val++; isws(*val); val++) {}
+	fdb_apnd(b, val, -1);
+	fdb_apnc(b, 0);
+}
+
 static int consumereqln(const char *pref)
 {
 	size_t plen = strlen(pref);
@@ -156,26 +195,253 @@ cleanup:
 	return !ers;
 }
 
+/* Decodes HTTP Basic credentials into authcred. */
+static void basicauth(void)
+{
+	size_t b64l;
+	int decl;
+
+	if (strncasecmp(reqcr, "basic ", 6))			return;
+	b64l = strlen(reqcr + 6);
+	if (b64l % 4 || b64l / 4 * 3 >= sizeof(authcred))	return;
+
+	decl = EVP_DecodeBlock((unsigned char *) authcred,
+			       (unsigned char *) reqcr + 6, b64l);
+	if (decl < 0) { *authcred = 0; return; }
+
+	/* Padding is decoded into trailing zeros. */
+	authcred[decl] = 0;
+}
+
+static void bearerauth(void)
+{
+	if (strncasecmp(reqcr, "bearer ", 7))		return;
+	if (strlen(reqcr + 7) >= sizeof(bearer))	return;
+	strcpy(bearer, reqcr + 7);
+}
+
+static void addfwdfor(void)
+{
+	size_t fl = strlen(fwdfor);
+
+	if (fl + strlen(reqcr) + 2 > sizeof(fwdfor)) { fwdlong = 1; return; }
+	if (fl) fwdfor[fl++] = ',';
+	strcpy(fwdfor + fl, reqcr);
+}
+
+static char *trimws(char *s)
+{
+	size_t l;
+
+	while (isws(*s)) s++;
+	for (l = strlen(s); l && isws(s[l-1]); l--) s[l-1] = 0;
+	return s;
+}
+
+/* Parses a window size parameter of permessage-deflate, which may be quoted.
+   Returns 0 if it is missing or not from min to 15. */
+static int wbitsval(char *v, int min)
+{
+	int n;
+
+	if (!v) return 0;
+	v = trimws(v);
+	if (*v == '"' && v[1] && v[strlen(v) - 1] == '"') {
+		v[strlen(v) - 1] = 0;
+		v++;
+	}
+	if (!*v || strspn(v, "0123456789") != strlen(v) || strlen(v) > 2)
+		return 0;
+
+	n = atoi(v);
+	return n >= min && n <= 15 ? n : 0;
+}
+
+/* Accepts the first permessage-deflate offer in the Sec-WebSocket-Extensions
+   header in reqcr whose parameters are all understood, as described in RFC
+   7692. */
+static void pmdoffer(Httpreq *rq)
+{
+	char *offr, *prm, *val, *nxo = reqcr, *nxp;
+	int bits, reset, seen, bit;
+
+	while (!rq->pmdeflate && (offr = strsep(&nxo, ","))) {
+		nxp = offr;
+		if (strcasecmp(trimws(strsep(&nxp, ";")), "permessage-deflate"))
+			continue;
+
+		bits = seen = 0;
+		reset = rq->deflatereset;
+		while ((prm = strsep(&nxp, ";"))) {
+			if ((val = strchr(prm, '='))) *val++ = 0;
+			prm = trimws(prm);
+
+			if (!strcasecmp(prm, "server_no_context_takeover")) {
+				bit = 1;
+				reset = 1;
+				if (val) break;
+			}
+			else if (!strcasecmp(prm, "client_no_context_takeover")) {
+				bit = 2;
+				if (val) break;
+			}
+			else if (!strcasecmp(prm, "server_max_window_bits")) {
+				bit = 4;
+				/* zlib cannot make raw deflate data with an 8-bit
+				   window. */
+				if (!(bits = wbitsval(val, 9))) break;
+			}
+			else if (!strcasecmp(prm, "client_max_window_bits")) {
+				bit = 8;
+				if (val && !wbitsval(val, 8)) break;
+			}
+			else break;
+
+			if (seen & bit) break;
+			seen |= bit;
+		}
+		if (prm) continue;
+
+		rq->pmdeflate = 1;
+		rq->deflatereset = reset;
+		rq->deflatebits = bits;
+	}
+}
+
+/* Picks the first protocol in the Sec-WebSocket-Protocol header in reqcr which
+   is also in rq->protocols. */
+static void pickproto(Httpreq *rq)
+{
+	char *p, *nx = reqcr;
+
+	while (!*rq->protocol && (p = strsep(&nx, ","))) {
+		p = trimws(p);
+		if (*p && strlen(p) < sizeof(rq->protocol)
+		    && inlist(rq->protocols, p))
+			strcpy(rq->protocol, p);
+	}
+}
+
+/* If the client is a trusted proxy, replaces rq->addr with the address it is
+   forwarding for. This is the last address in X-Forwarded-For which is not a
+   trusted proxy, or X-Real-IP if there is no X-Forwarded-For. */
+static void fwdclient(Httpreq *rq)
+{
+	char *c, *fwd = realip;
+
+	if (!rq->trustproxy) return;
+	if (strcmp(rq->addr, "local") && !addrinlist(rq->trustproxy, rq->addr))
+		return;
+
+	if (*fwdfor) {
+		while ((c = strrchr(fwdfor, ','))
+		       && addrinlist(rq->trustproxy, trimws(c + 1)))
+			*c = 0;
+		fwd = c ? c + 1 : fwdfor;
+	}
+	fwd = trimws(fwd);
+
+	/* Don't let a client hide its address by sending a long header. */
+	if (fwdlong || strlen(fwd) >= sizeof(rq->addr)) fwd = "unknown";
+
+	if (*fwd) strcpy(rq->addr, fwd);
+}
+
+/* Decodes the value of the query arg nm= into out. Returns 0 if it is missing
+   or too long. */
+static int qryval(const char *q, const char *nm, char *out, size_t outsz)
+{
+	size_t nml = strlen(nm);
+	unsigned byte;
+	int bcnt;
+
+	for (; *q; q = strchrnul(q, '&'), q += !!*q)
+		if (!strncmp(q, nm, nml) && q[nml] == '=') break;
+	if (!*q) return 0;
+
+	for (q += nml + 1; *q && *q != '&'; q++) {
+		if (!--outsz) return 0;
+
+		byte = *q;
+		bcnt = 0;
+		if (byte == '%' && sscanf(q+1, "%2x%n", &byte, &bcnt) && bcnt == 2)
+			q += 2;
+		*out++ = byte;
+	}
+	*out = 0;
+	return 1;
+}
+
+/* Checks the bearer token or token= query arg against rq->authtoken, taking
+   the same time regardless of how much of it matches. */
+static int tokenok(Httpreq *rq)
+{
+	char qtok[sizeof(bearer)];
+	const char *tok = bearer;
+	size_t tl = strlen(rq->authtoken);
+
+	if (!*tok && qryval(rq->query, "token", qtok, sizeof(qtok))) tok = qtok;
+
+	return *tok && strlen(tok) == tl && !CRYPTO_memcmp(tok, rq->authtoken, tl);
+}
+
+/* Health probes are answered without credentials, so an orchestrator need not
+   be given any. */
+static int isprobe(const char *rs)
+{
+	return !strcmp(rs, "/healthz") || !strcmp(rs, "/readyz");
+}
+
+/* Checks the credentials in authcred against the htpasswd file. */
+static int authok(Httpreq *rq)
+{
+	FILE *f;
+	char *pw = strchr(authcred, ':');
+	int ok;
+
+	if (!pw) return 0;
+	*pw++ = 0;
+	if (strlen(authcred) >= sizeof(rq->user)) return 0;
+
+	if (!(f = fopen(rq->htpasswd, "r"))) {
+		perror("open htpasswd file");
+		return 0;
+	}
+	ok = htpasswd_ok(f, authcred, pw);
+	fclose(f);
+
+	if (ok) strcpy(rq->user, authcred);
+	return ok;
+}
+
 void http_read_req(FILE *src, Httpreq *rq, struct wrides *respout)
 {
 	char *rc, *qstart;
 	int connectionupgr = 0, goodwsver = 0, upgradews = 0, wsconds = -1;
+	unsigned hdrs = 0, hdrbytes = 0;
+	int ers;
+	char origin = 0;
+	unsigned maxhdrs = rq->maxhdrs ? rq->maxhdrs : 100;
+	unsigned maxhdrbytes = rq->maxhdrbytes ? rq->maxhdrbytes : 16384;
 	struct fdbuf respbuf = {0};
 
+	*acceptkey = 0;
+	*authcred = *bearer = *fwdfor = *realip = 0;
+	lastcode = 0;
+	fwdlong = 0;
+
 	if (!readreqln(src)) goto badreq;
 
 	if (	consumereqln("PUT ")
 	    ||	consumereqln("POST ")
-	    ||	consumereqln("DELETE ")
 	    ||	consumereqln("CONNECT ")
 	    ||	consumereqln("OPTIONS ")
 	    ||	consumereqln("TRACE ")
 	    ||	consumereqln("PATCH ")) goto methoderr;
 
-	if (!consumereqln("GET ")) {
-		if (!consumereqln("HEAD ")) goto badreq;
-		rq->head = 1;
-	}
+	if (consumereqln("HEAD "))		rq->head = 1;
+	else if (consumereqln("DELETE "))	rq->del = 1;
+	else if (!consumereqln("GET "))		goto badreq;
 
 	if (llen < 9) goto badreq;
 	if (strcmp(" HTTP/1.1", reqcr + llen - 9)) goto badreq;
@@ -194,10 +460,18 @@ void http_read_req(FILE *src, Httpreq *rq, struct wrides *respout)
 	strcpy(rq->resource, reqcr);
 
 	for (;;) {
-		readreqln(src);
+		if (!readreqln(src)) {
+			/* A line filling the buffer is too long to process. */
+			if (strlen(reqln) == sizeof(reqln) - 1) goto toolarge;
+			goto badreq;
+		}
 		if (!llen) break;
 
+		hdrbytes += llen + 2;
+		if (++hdrs > maxhdrs || hdrbytes > maxhdrbytes) goto toolarge;
+
 		for (rc = reqln; *rc && *rc != ':'; rc++) lcase(rc);
+		if (rq->hdrenv) hdrtoenv(rq->hdrenv);
 
 		if (consumereqln("sec-fetch-site:")) {
 			if (strcmp("same-origin",	reqcr) &&
@@ -207,6 +481,10 @@ void http_read_req(FILE *src, Httpreq *rq, struct wrides *respout)
 				rq->restrictfetchsite = 1;
 		}
 
+		if (consumereqln("origin:")) {
+			origin = strcmp(reqcr, "null") ? 'o' : 'n';
+			continue;
+		}
 		if (consumereqln("upgrade:")) {
 			if (!strcmp(reqcr, "websocket")) upgradews = 1;
 			continue;
@@ -223,8 +501,41 @@ void http_read_req(FILE *src, Httpreq *rq, struct wrides *respout)
 			if (!procwskeyhdr(reqcr, respout)) goto seterr;
 			continue;
 		}
+		if (consumereqln("sec-websocket-protocol:")) {
+			if (rq->protocols) pickproto(rq);
+			continue;
+		}
+		if (consumereqln("sec-websocket-extensions:")) {
+			if (rq->deflate >= 1 && rq->deflate <= 9) pmdoffer(rq);
+			continue;
+		}
+		if (consumereqln("authorization:")) {
+			basicauth();
+			bearerauth();
+			continue;
+		}
+		if (consumereqln("x-forwarded-for:")) {
+			addfwdfor();
+			continue;
+		}
+		if (consumereqln("x-real-ip:")) {
+			if (strlen(reqcr) < sizeof(realip)) strcpy(realip, reqcr);
+			continue;
+		}
 	}
 
+	fwdclient(rq);
+
+	if ((rq->denyip && addrinlist(rq->denyip, rq->addr))
+	    || (rq->allowip && !addrinlist(rq->allowip, rq->addr))) {
+		fdb_apnd(&respbuf, "address not allowed\n", -1);
+		rq->addrdenied = 1;
+		goto forbidn;
+	}
+
+	if (rq->htpasswd && !isprobe(rq->resource) && !authok(rq))
+		goto unauthn;
+
 	wsconds = (upgradews		? 1 : 0)
 		| (connectionupgr	? 2 : 0)
 		| (goodwsver		? 4 : 0)
@@ -232,7 +543,27 @@ void http_read_req(FILE *src, Httpreq *rq, struct wrides *respout)
 
 	if (!wsconds)		goto cleanup;
 	if (wsconds != 15)	goto badreq;
-	if (rq->head)		goto methoderr;
+	if (rq->head || rq->del) goto methoderr;
+
+	if (rq->authtoken && !tokenok(rq)) {
+		fdb_apnd(&respbuf, "missing or wrong token\n", -1);
+		rq->unauthd = 1;
+		goto forbidn;
+	}
+	if (!origin && rq->denynoorig) {
+		fdb_apnd(&respbuf, "Origin header is required\n", -1);
+		goto forbidn;
+	}
+	if (origin == 'n' && rq->denynullorig) {
+		fdb_apnd(&respbuf, "null Origin is not allowed\n", -1);
+		goto forbidn;
+	}
+
+	if (rq->allowws && (ers = rq->allowws(rq->allowctx))) {
+		rq->unauthd = 1;
+		resp_dynamc(respout, 't', ers, 0, 0);
+		goto seterr;
+	}
 
 	rq->validws = 1;
 	fdb_apnd(&respbuf,	"HTTP/1.1 101 Switching Protocols\r\n"
@@ -241,6 +572,20 @@ void http_read_req(FILE *src, Httpreq *rq, struct wrides *respout)
 				"Sec-WebSocket-Accept: ", -1);
 
 	fdb_apnd(&respbuf, acceptkey, -1);
+	if (*rq->protocol) {
+		fdb_apnd(&respbuf, "\r\nSec-WebSocket-Protocol: ", -1);
+		fdb_apnd(&respbuf, rq->protocol, -1);
+	}
+	if (rq->pmdeflate) {
+		fdb_apnd(&respbuf,
+			 "\r\nSec-WebSocket-Extensions: permessage-deflate", -1);
+		if (rq->deflatereset)
+			fdb_apnd(&respbuf, "; server_no_context_takeover", -1);
+		if (rq->deflatebits) {
+			fdb_apnd(&respbuf, "; server_max_window_bits=", -1);
+			fdb_itoa(&respbuf, rq->deflatebits);
+		}
+	}
 	fdb_apnd(&respbuf, "\r\n\r\n", -1);
 	full_write(respout, respbuf.bf, respbuf.len);
 	goto cleanup;
@@ -249,6 +594,19 @@ methoderr:
 	resp_dynamc(respout, 't', 405, 0, 0);
 	goto seterr;
 
+unauthn:
+	rq->unauthd = 1;
+	resp_dynamc(respout, 't', 401, 0, 0);
+	goto seterr;
+
+forbidn:
+	resp_dynamc(respout, 't', 403, respbuf.bf, respbuf.len);
+	goto seterr;
+
+toolarge:
+	resp_dynamc(respout, 't', 431, 0, 0);
+	goto seterr;
+
 badreq:
 	fdb_apnd(&respbuf, "bad request\n", -1);
 	fdb_apnd(&respbuf, "websocket upgrade conditions: ", -1);
@@ -269,8 +627,14 @@ static void dumpreq(Httpreq *rq)
 
 	printf("resource: %s\n", rq->resource);
 	if (*rq->query) printf("query: %s\n", rq->query);
+	if (*rq->user) printf("user: %s\n", rq->user);
 	printf("restrict fetch site: %u valid ws: %u head: %u\n",
 	       rq->restrictfetchsite, rq->validws, rq->head);
+	if (rq->del) puts("delete");
+	if (*rq->protocol) printf("protocol: %s\n", rq->protocol);
+	if (rq->pmdeflate)
+		printf("deflate: bits %d reset %u\n",
+		       rq->deflatebits, rq->deflatereset);
 }
 
 static void resettmpfile(FILE **f)
@@ -282,6 +646,8 @@ static void resettmpfile(FILE **f)
 	*f = tmpfile();
 }
 
+int resp_lastcode(void) { return lastcode; }
+
 static void resphdr(struct wrides *de, int code, char hdr, size_t contlength)
 {
 	struct fdbuf b = {de, 512};
@@ -292,11 +658,15 @@ static void resphdr(struct wrides *de, int code, char hdr, size_t contlength)
 	default: abort();
 		case 200: xfdeny=1; codest="200 OK";
 	break;	case 400: xfdeny=0; codest="400 Bad Request";
+	break;	case 401: xfdeny=0; codest="401 Unauthorized";
 	break;	case 403: xfdeny=0; codest="403 Forbidden";
 	break;	case 404: xfdeny=0; codest="404 Not Found";
 	break;	case 405: xfdeny=0; codest="405 Method Not Allowed";
+	break;	case 431: xfdeny=0; codest="431 Request Header Fields Too Large";
 	break;	case 500: xfdeny=0; codest="500 Internal Server Error";
+	break;	case 503: xfdeny=0; codest="503 Service Unavailable";
 	}
+	lastcode = code;
 
 	switch (hdr) {
 	default: abort();
@@ -311,6 +681,8 @@ static void resphdr(struct wrides *de, int code, char hdr, size_t contlength)
 	fdb_apnd(&b, codest, -1);
 	fdb_apnd(&b, "\r\n", 2);
 	if (xfdeny) fdb_apnd(&b, "X-Frame-Options: DENY\r\n", -1);
+	if (code == 401)
+		fdb_apnd(&b, "WWW-Authenticate: Basic realm=\"werm\"\r\n", -1);
 
 	fdb_apnd(&b, "Connection: keep-alive\r\n", -1);
 	fdb_apnd(&b, "Content-Type: ", -1);
@@ -376,11 +748,29 @@ void resp_dynamc(struct wrides *de, char hdr, int code, void *b, size_t sz)
 	full_write(de, b, sz);
 }
 
+/* Prints the environment an auth hook would get and allows the connection if
+   it has the X-Pass header. */
+static int testallowws(void *ctx)
+{
+	Httpreq *rq = ctx;
+	char *e = (char *) rq->hdrenv->bf, *end = e + rq->hdrenv->len;
+	int ers = 403;
+
+	for (; e < end; e += strlen(e) + 1) {
+		printf("env: %s\n", e);
+		if (!strcmp(e, "HTTP_X_PASS=letmein")) ers = 0;
+	}
+	return ers;
+}
+
 void test_http(void)
 {
 	struct wrides de = {1, "httpresp"};
 	FILE *src = tmpfile();
 	Httpreq rq;
+	struct fdbuf hdrenv = {0};
+	int i, htpfd;
+	char htpfn[] = "/tmp/wermhtpasswd.XXXXXX";
 
 	puts("TRIVIAL RESOURCE AND BLANK QUERY");
 	memset(&rq, 0, sizeof(rq));
@@ -408,6 +798,61 @@ void test_http(void)
 	dumpreq(&rq);
 	resettmpfile(&src);
 
+	puts("TEST PERMESSAGE-DEFLATE");
+	memset(&rq, 0, sizeof(rq));
+	rq.deflate = 6;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: WTh9rpWlwlBcMRUQqbXuFg==\r\nSec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("TEST PERMESSAGE-DEFLATE FIRST ACCEPTABLE OFFER");
+	memset(&rq, 0, sizeof(rq));
+	rq.deflate = 9;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: WTh9rpWlwlBcMRUQqbXuFg==\r\nSec-WebSocket-Extensions: x-webkit-deflate-frame, permessage-deflate; server_max_window_bits=8, permessage-deflate; mystery\r\nSec-WebSocket-Extensions: Permessage-Deflate; server_no_context_takeover; server_max_window_bits=\"10\"; client_max_window_bits=12\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("TEST PERMESSAGE-DEFLATE RESET BY SERVER");
+	memset(&rq, 0, sizeof(rq));
+	rq.deflate = 1;
+	rq.deflatereset = 1;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: WTh9rpWlwlBcMRUQqbXuFg==\r\nSec-WebSocket-Extensions: permessage-deflate; client_no_context_takeover; client_no_context_takeover, permessage-deflate; client_no_context_takeover\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("TEST PERMESSAGE-DEFLATE NO ACCEPTABLE OFFER");
+	memset(&rq, 0, sizeof(rq));
+	rq.deflate = 6;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: WTh9rpWlwlBcMRUQqbXuFg==\r\nSec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=16, permessage-deflate; server_no_context_takeover=1\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("TEST SUBPROTOCOL");
+	memset(&rq, 0, sizeof(rq));
+	rq.protocols = "term.v2,term.v1";
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: WTh9rpWlwlBcMRUQqbXuFg==\r\nSec-WebSocket-Protocol: term.v3, term.v\r\nSec-WebSocket-Protocol: term.v1 ,term.v2\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("TEST SUBPROTOCOL NOT ACCEPTED");
+	memset(&rq, 0, sizeof(rq));
+	rq.protocols = "term.v2";
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: WTh9rpWlwlBcMRUQqbXuFg==\r\nSec-WebSocket-Protocol: term.v1\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
 	puts("TEST ACCEPT-KEY AGAIN");
 	memset(&rq, 0, sizeof(rq));
 	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: j/26SYgMGzb8gVdanOs/2A==\r\n\r\n", src);
@@ -432,6 +877,22 @@ void test_http(void)
 	dumpreq(&rq);
 	resettmpfile(&src);
 
+	puts("DELETE METHOD");
+	memset(&rq, 0, sizeof(rq));
+	fputs("DELETE /admin?termid=x.y HTTP/1.1\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("WEBSOCKET UPGRADE WITH DELETE");
+	memset(&rq, 0, sizeof(rq));
+	fputs("DELETE / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
 	puts("WEBSOCKET UPGRADE: KEY TOO SHORT");
 	memset(&rq, 0, sizeof(rq));
 	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25j\r\n\r\n", src);
@@ -456,5 +917,278 @@ void test_http(void)
 	dumpreq(&rq);
 	resettmpfile(&src);
 
+	puts("WEBSOCKET UPGRADE: NULL ORIGIN DENIED");
+	memset(&rq, 0, sizeof(rq));
+	rq.denynullorig = 1;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: null\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("WEBSOCKET UPGRADE: NULL ORIGIN ALLOWED");
+	memset(&rq, 0, sizeof(rq));
+	rq.denynoorig = 1;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: null\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("WEBSOCKET UPGRADE: MISSING ORIGIN DENIED");
+	memset(&rq, 0, sizeof(rq));
+	rq.denynoorig = 1;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("MISSING ORIGIN WITHOUT UPGRADE");
+	memset(&rq, 0, sizeof(rq));
+	rq.denynoorig = 1;
+	fputs("GET /attach HTTP/1.1\r\nHost: localhost:8090\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("TOO MANY HEADERS");
+	memset(&rq, 0, sizeof(rq));
+	rq.maxhdrs = 2;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nPragma: no-cache\r\nCache-Control: no-cache\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("HEADERS AT COUNT LIMIT");
+	memset(&rq, 0, sizeof(rq));
+	rq.maxhdrs = 3;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nPragma: no-cache\r\nCache-Control: no-cache\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("HEADERS TOO MANY BYTES");
+	memset(&rq, 0, sizeof(rq));
+	rq.maxhdrbytes = 40;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nPragma: no-cache\r\nCache-Control: no-cache\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("HEADER LINE TOO LONG");
+	memset(&rq, 0, sizeof(rq));
+	fputs("GET / HTTP/1.1\r\nX-Long: ", src);
+	for (i = 0; i < 64; i++) fputs("0123456789", src);
+	fputs("\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("HEADER TRUNCATED");
+	memset(&rq, 0, sizeof(rq));
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	htpfd = mkstemp(htpfn);
+	if (htpfd < 0) { perror("mkstemp"); exit(1); }
+	full_write(&(struct wrides){htpfd},
+		   "md5:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n", -1);
+	close(htpfd);
+
+	puts("NO CREDENTIALS");
+	memset(&rq, 0, sizeof(rq));
+	rq.htpasswd = htpfn;
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("GOOD CREDENTIALS");
+	memset(&rq, 0, sizeof(rq));
+	rq.htpasswd = htpfn;
+	fputs("GET /attach HTTP/1.1\r\nAuthorization: Basic bWQ1OnNlY3JldA==\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("GOOD CREDENTIALS, LOWERCASE SCHEME");
+	memset(&rq, 0, sizeof(rq));
+	rq.htpasswd = htpfn;
+	fputs("GET /attach HTTP/1.1\r\nauthorization: basic bWQ1OnNlY3JldA==\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("WRONG PASSWORD");
+	memset(&rq, 0, sizeof(rq));
+	rq.htpasswd = htpfn;
+	fputs("GET / HTTP/1.1\r\nAuthorization: Basic bWQ1Ondyb25n\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("NO CREDENTIALS FOR HEALTH PROBE");
+	memset(&rq, 0, sizeof(rq));
+	rq.htpasswd = htpfn;
+	fputs("GET /readyz HTTP/1.1\r\nHost: localhost:8090\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("CREDENTIALS NOT CHECKED WITHOUT HTPASSWD");
+	memset(&rq, 0, sizeof(rq));
+	fputs("GET / HTTP/1.1\r\nAuthorization: Basic bWQ1Ondyb25n\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	unlink(htpfn);
+
+	puts("WEBSOCKET WITHOUT TOKEN");
+	memset(&rq, 0, sizeof(rq));
+	rq.authtoken = "s3cret";
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: j/26SYgMGzb8gVdanOs/2A==\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	printf("unauthd: %u\n", rq.unauthd);
+	resettmpfile(&src);
+
+	puts("WEBSOCKET WITH BEARER TOKEN");
+	memset(&rq, 0, sizeof(rq));
+	rq.authtoken = "s3cret";
+	fputs("GET / HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: j/26SYgMGzb8gVdanOs/2A==\r\nAuthorization: Bearer s3cret\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	printf("unauthd: %u\n", rq.unauthd);
+	resettmpfile(&src);
+
+	puts("WEBSOCKET WITH WRONG BEARER TOKEN");
+	memset(&rq, 0, sizeof(rq));
+	rq.authtoken = "s3cret";
+	fputs("GET /?token=s3cret HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: j/26SYgMGzb8gVdanOs/2A==\r\nAuthorization: Bearer s3cre\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	printf("unauthd: %u\n", rq.unauthd);
+	resettmpfile(&src);
+
+	puts("WEBSOCKET WITH QUERY TOKEN");
+	memset(&rq, 0, sizeof(rq));
+	rq.authtoken = "s3cret";
+	fputs("GET /?termid=x&token=s3c%72et HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: j/26SYgMGzb8gVdanOs/2A==\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	printf("unauthd: %u\n", rq.unauthd);
+	resettmpfile(&src);
+
+	puts("WEBSOCKET WITH WRONG QUERY TOKEN");
+	memset(&rq, 0, sizeof(rq));
+	rq.authtoken = "s3cret";
+	fputs("GET /?token=s3cretx&termid=x HTTP/1.1\r\nHost: localhost:8090\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nOrigin: http://localhost:8090\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: j/26SYgMGzb8gVdanOs/2A==\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	printf("unauthd: %u\n", rq.unauthd);
+	resettmpfile(&src);
+
+	puts("TOKEN NOT NEEDED WITHOUT UPGRADE");
+	memset(&rq, 0, sizeof(rq));
+	rq.authtoken = "s3cret";
+	fputs("GET /attach HTTP/1.1\r\n\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	dumpreq(&rq);
+	resettmpfile(&src);
+
+	puts("ADDRESS NOT ALLOWED");
+	for (i = 0; i < 3; i++) {
+		memset(&rq, 0, sizeof(rq));
+		strcpy(rq.addr, i == 2 ? "10.9.8.7" : "192.168.0.5");
+		rq.allowip = "10.0.0.0/8,192.168.0.0/16";
+		rq.denyip = i ? "192.168.0.5" : 0;
+		fputs("GET /showenv HTTP/1.1\r\n\r\n", src);
+		fseek(src, 0, SEEK_SET);
+		http_read_req(src, &rq, &de);
+		dumpreq(&rq);
+		printf("addrdenied: %u\n", rq.addrdenied);
+		resettmpfile(&src);
+	}
+
+	puts("FORWARDED FOR");
+	for (i = 0; i < 7; i++) {
+		const char *hdrs[] = {
+			"X-Forwarded-For: 203.0.113.5\r\n",
+			"X-Forwarded-For: 6.6.6.6, 203.0.113.5, 10.1.1.1\r\n",
+			"X-Forwarded-For: 6.6.6.6\r\n"
+			"X-Forwarded-For: 203.0.113.5\r\n",
+			"X-Real-IP: 203.0.113.9\r\n",
+			"X-Forwarded-For: 10.1.1.1,10.2.2.2\r\n",
+			"",
+			"X-Forwarded-For: 203.0.113.5\r\n",
+		};
+		memset(&rq, 0, sizeof(rq));
+		strcpy(rq.addr, i == 6 ? "192.0.2.1" : "10.0.0.1");
+		rq.trustproxy = "10.0.0.0/8";
+		fprintf(src, "GET / HTTP/1.1\r\n%s\r\n", hdrs[i]);
+		fseek(src, 0, SEEK_SET);
+		http_read_req(src, &rq, &de);
+		printf("addr: %s\n", rq.addr);
+		resettmpfile(&src);
+	}
+
+	puts("FORWARDED FOR IS TOO LONG");
+	memset(&rq, 0, sizeof(rq));
+	strcpy(rq.addr, "10.0.0.1");
+	rq.trustproxy = "10.0.0.0/8";
+	rq.allowip = "10.0.0.0/8";
+	fputs("GET / HTTP/1.1\r\n", src);
+	for (i = 0; i < 60; i++) fputs("X-Forwarded-For: 10.0.0.1\r\n", src);
+	fputs("\r\n", src);
+	fseek(src, 0, SEEK_SET);
+	http_read_req(src, &rq, &de);
+	printf("addr: %s addrdenied: %u\n", rq.addr, rq.addrdenied);
+	resettmpfile(&src);
+
+	puts("EXTERNAL AUTH HOOK");
+	for (i = 0; i < 2; i++) {
+		memset(&rq, 0, sizeof(rq));
+		rq.hdrenv = &hdrenv;
+		rq.allowws = testallowws;
+		rq.allowctx = &rq;
+		fprintf(src, "GET / HTTP/1.1\r\n"
+			     "Connection: Upgrade\r\n"
+			     "Upgrade: websocket\r\n"
+			     "Sec-WebSocket-Version: 13\r\n"
+			     "x-Pass: %s\r\n"
+			     "Proxy: http://evil.example:8080\r\n"
+			     "Authorization: Basic Zm9vOmJhcg==\r\n"
+			     "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+			     "\r\n", i ? "letmein" : "nope");
+		fseek(src, 0, SEEK_SET);
+		http_read_req(src, &rq, &de);
+		dumpreq(&rq);
+		printf("unauthd: %u\n", rq.unauthd);
+		fdb_finsh(&hdrenv);
+		resettmpfile(&src);
+	}
+
 	fclose(src);
 }
@@ -9,6 +9,77 @@
 #include <stdio.h>
 
 typedef struct {
+	/* Limits on the number of header lines and their total size in bytes,
+	   set by the caller. Zero means use the default limit. */
+	unsigned maxhdrs, maxhdrbytes;
+
+	/* Set by the caller to reject websocket upgrades with "Origin: null",
+	   as sent by sandboxed iframes and file:// pages, or without an Origin
+	   header, as sent by non-browser clients. */
+	unsigned denynullorig : 1;
+	unsigned denynoorig : 1;
+
+	/* Set by the caller to the client address. If allowip is set, only
+	   clients in those networks are served, and if denyip is set, clients
+	   in them are not. Both are comma-separated lists of CIDRs, e.g.
+	   "10.0.0.0/8,::1". Other clients get a 403 response. */
+	char addr[64];
+	const char *allowip, *denyip;
+
+	/* If set by the caller, comma-separated CIDRs of proxies whose
+	   X-Forwarded-For or X-Real-IP header is trusted. When a request comes
+	   from one of them, or over a Unix socket, addr is replaced by the
+	   address the proxy gives. */
+	const char *trustproxy;
+
+	/* If set by the caller, the path of an htpasswd file. Requests without
+	   HTTP Basic credentials in the file get a 401 response. */
+	const char *htpasswd;
+
+	/* If set by the caller, websocket upgrades must give this token in an
+	   "Authorization: Bearer" header or a token= query arg, or they get a
+	   403 response. */
+	const char *authtoken;
+
+	/* If set by the caller, each header is appended to hdrenv in the form
+	   of a CGI environment variable, e.g. "HTTP_USER_AGENT=curl/8.0",
+	   followed by a null byte. */
+	struct fdbuf *hdrenv;
+
+	/* If set by the caller to a zlib compression level from 1 to 9, the
+	   permessage-deflate extension is accepted when a websocket client
+	   offers it. If deflatereset is set, each message is compressed without
+	   the context of earlier ones. It is also set if the client asks for
+	   that. */
+	int deflate;
+	unsigned deflatereset : 1;
+
+	/* Set if permessage-deflate was accepted. deflatebits is the window
+	   size in bits the client allowed for compressing, or 0 if it did not
+	   limit it. */
+	unsigned pmdeflate : 1;
+	int deflatebits;
+
+	/* If set by the caller, a comma-separated list of websocket
+	   subprotocols to accept. The first one the client offers which is in
+	   the list is put in protocol and given in the response. */
+	const char *protocols;
+	char protocol[64];
+
+	/* If set by the caller, called before accepting a websocket upgrade. It
+	   returns 0 to accept it, or the status code of the error response. */
+	int (*allowws)(void *allowctx);
+	void *allowctx;
+
+	/* The user name from the credentials, once they are verified. */
+	char user[64];
+
+	/* Set if the request was rejected for missing or wrong credentials. */
+	unsigned unauthd : 1;
+
+	/* Set if the request was rejected because of the client address. */
+	unsigned addrdenied : 1;
+
 	char resource[32];
 	char query[512];
 
@@ -26,11 +97,16 @@ typedef struct {
 	/* Indicates a HEAD rather than a GET request. */
 	unsigned head : 1;
 
+	/* Indicates a DELETE request, which only the admin= path accepts. */
+	unsigned del : 1;
+
 	/* Indicates the client added keep-alive to the Connection header. */
 	unsigned keepaliv : 1;
 } Httpreq;
 
-/* Process request header from |src|.
+/* Process request header from |src|. If the header exceeds the limits in |rq|,
+   it is rejected with a 431 response without processing the rest. If the
+   credentials are not accepted, it is rejected with a 401 response.
    respout - where HTTP errors and websocket upgrade responses are printed */
 void http_read_req(FILE *src, Httpreq *rq, struct wrides *errresp);
 
@@ -49,6 +125,10 @@ void http_read_req(FILE *src, Httpreq *rq, struct wrides *errresp);
 void resp_static(struct wrides *de, char hdr, const char *path);
 void resp_dynamc(struct wrides *de, char hdr, int code, void *b, size_t sz);
 
+/* Returns the status code of the last response header written since
+   http_read_req was called, or 0 if there was none. */
+int resp_lastcode(void);
+
 /* Exercises http functionality and writes test output to stdout, to be compared
    with golden test data. */
 void test_http(void);
@@ -5,25 +5,43 @@
  * https://developers.google.com/open-source/licenses/bsd */
 
 #include "inbound.h"
+#include "metrics.h"
+#include "shared.h"
 #include <arpa/inet.h>
 #include <string.h>
 #include <stdint.h>
 #include <stdlib.h>
 #include <errno.h>
 #include <stdio.h>
+#include <time.h>
+#include <zlib.h>
 
 static unsigned char buf[512];
 static unsigned bfi, bfsz;
 static unsigned char pongmsg[2] = {0x8a, 0x00};
 
-static void mkeaval(int c)
+/* The permessage-deflate decompressor, and whether the message being read is
+   compressed. */
+static z_stream infl;
+static int compr;
+
+/* Bytes in the message being read so far. For a compressed message, this
+   counts them after decompressing. */
+static uint64_t msglen;
+
+/* When the client last sent a frame, and when it was pinged without sending
+   anything since. */
+static time_t lastheard, pinged;
+
+/* Returns 0 if stdin reached EOF before c bytes were available. */
+static int mkeaval(int c)
 {
 	ssize_t redn;
 	unsigned bleft = bfsz - bfi;
 
 	if (c > sizeof(buf)) abort();
 
-	if (bleft >= c) return;
+	if (bleft >= c) return 1;
 
 	bfsz = bleft;
 	memmove(buf, buf+bfi, bfsz);
@@ -36,83 +54,151 @@ static void mkeaval(int c)
 			perror("read stdin mid-frame");
 			abort();
 		}
-		if (!redn) abort();
+		if (!redn) return 0;
 		bfsz += redn;
 	}
 	while (bfsz < c);
+
+	return 1;
 }
 
 static unsigned char *forceinby(int c)
 {
-	mkeaval(c);
+	if (!mkeaval(c)) abort();
 	bfi += c;
 	return buf + bfi - c;
 }
 
-void fwrd_inbound_frames(int sock)
+/* Adds to the size of the message being read, and closes the connection if it
+   is over the maxmsg= limit. */
+static void addmsglen(uint64_t n)
+{
+	long long max = wbsoc_maxmsg();
+
+	msglen += n;
+	if (max <= 0 || msglen <= max) return;
+
+	fprintf(stderr, "websocket message over %lld bytes; closing\n", max);
+	write_wbsoc_close(1009);
+	exit(1);
+}
+
+/* Decompresses part of a message and forwards the result to sock. */
+static void inflfwd(int sock, unsigned char *b, size_t len)
+{
+	unsigned char out[1024];
+	int zr;
+
+	if (!infl.state && Z_OK != inflateInit2(&infl, -15)) abort();
+
+	infl.next_in = b;
+	infl.avail_in = len;
+	do {
+		infl.next_out = out;
+		infl.avail_out = sizeof(out);
+		zr = inflate(&infl, Z_SYNC_FLUSH);
+		if (zr != Z_OK && zr != Z_BUF_ERROR && zr != Z_STREAM_END) {
+			fprintf(stderr, "inflate websocket message: %s\n",
+				infl.msg ? infl.msg : "error");
+			abort();
+		}
+		addmsglen(sizeof(out) - infl.avail_out);
+		full_write(&(struct wrides){sock}, out,
+			   sizeof(out) - infl.avail_out);
+
+		/* The client ended the stream with a final block, so the next
+		   message starts a new one. */
+		if (zr == Z_STREAM_END) inflateReset(&infl);
+	}
+	while (!infl.avail_out || (zr == Z_STREAM_END && infl.avail_in));
+}
+
+int fwrd_inbound_frames(int sock)
 {
 	unsigned char mask[4];
 	uint64_t datalen;
 	uint32_t datalen32;
 	uint16_t datalen16;
-	int unmaski, datpart, unmaskof;
+	int unmaski, datpart, unmaskof, opcode, fin;
 	unsigned char *bfc;
 
 	if (bfi != bfsz) abort();
 
 	do {
+		/* The client may close the stream between frames. */
+		if (!mkeaval(1)) return 'e';
+
+		lastheard = time(0);
 		bfc = forceinby(1);
+		opcode = *bfc & 0x0f;
+		fin = *bfc & 0x80;
 
-		/* We don't care whether continuation or FIN */
-		*bfc &= 0x7f;
+		/* RSV1 on the first frame of a message means it is compressed
+		   with permessage-deflate. */
+		if (opcode == 1 || opcode == 2) compr = !!(*bfc & 0x40);
 
-		switch (*bfc) {
-		default: break; /* close, pong, or reserved code */
-		case 0: case 1: case 2:
-			/* data */
+		/* Payload len */
+		bfc = forceinby(1);
+		datalen = *bfc & 0x7f;
 
-			/* Payload len */
-			bfc = forceinby(1);
-			datalen = *bfc & 0x7f;
+		/* Should always send mask */
+		if (!(*bfc & 0x80)) abort();
 
-			/* Should always send mask */
-			if (!(*bfc & 0x80)) abort();
+		/* Client should not send large frames that require
+		 * extended payload length. */
+		if (datalen == 126) {
+			memcpy(&datalen16, forceinby(2), 2);
 
-			/* Client should not send large frames that require
-			 * extended payload length. */
-			if (datalen == 126) {
-				memcpy(&datalen16, forceinby(2), 2);
+			datalen = ntohs(datalen16);
+		}
+		else if (datalen == 127) {
+			memcpy(&datalen32, forceinby(4), 4);
+			datalen = ntohl(datalen32);
+			datalen <<= 32;
 
-				datalen = ntohs(datalen16);
-			}
-			else if (datalen == 127) {
-				memcpy(&datalen32, forceinby(4), 4);
-				datalen = ntohl(datalen32);
-				datalen <<= 32;
+			memcpy(&datalen32, forceinby(4), 4);
+			datalen |= ntohl(datalen32);
+		}
 
-				memcpy(&datalen32, forceinby(4), 4);
-				datalen |= ntohl(datalen32);
-			}
+		/* Read the mask */
+		memcpy(mask, forceinby(4), 4);
 
-			/* Read the mask */
-			memcpy(mask, forceinby(4), 4);
+		/* Check the size before forwarding any of the frame. */
+		if (opcode == 1 || opcode == 2) msglen = 0;
+		if (opcode <= 2 && !compr) addmsglen(datalen);
 
-			unmaskof = 0;
-			while (datalen) {
-				datpart = sizeof(buf);
-				if (datpart > datalen) datpart = datalen;
+		/* Payloads of control frames are read but not used. */
+		unmaskof = 0;
+		while (datalen) {
+			datpart = sizeof(buf);
+			if (datpart > datalen) datpart = datalen;
 
-				bfc = forceinby(datpart);
-				for (unmaski = 0; unmaski < datpart; unmaski++) {
-					bfc[unmaski] ^= mask[unmaskof++];
-					unmaskof &= 3;
-				}
+			bfc = forceinby(datpart);
+			datalen -= datpart;
 
-				full_write(&(struct wrides){sock}, bfc, datpart);
+			/* data */
+			if (opcode > 2) continue;
 
-				datalen -= datpart;
+			for (unmaski = 0; unmaski < datpart; unmaski++) {
+				bfc[unmaski] ^= mask[unmaskof++];
+				unmaskof &= 3;
 			}
-		break;
+
+			if (compr)	inflfwd(sock, bfc, datpart);
+			else		full_write(&(struct wrides){sock}, bfc,
+					   datpart);
+			TRAFFIC_ADD(bytesin, datpart);
+		}
+		if (opcode <= 2) TRAFFIC_ADD(msgsin, 1);
+
+		/* The sender dropped the empty block that ends each
+		   compressed message. */
+		if (opcode <= 2 && fin && compr)
+			inflfwd(sock, (unsigned char *) "\0\0\xff\xff", 4);
+
+		switch (opcode) {
+		case 8:
+			return 'c';
 		case 9:
 			/* pinged, so respond with pong */
 			full_write(&(struct wrides){1},
@@ -121,4 +207,32 @@ void fwrd_inbound_frames(int sock)
 		}
 	}
 	while (bfi < bfsz);
+
+	return 0;
+}
+
+int wbsoc_keepalive(void)
+{
+	int intvl, tmo;
+	time_t now = time(0);
+
+	wbsoc_pings(&intvl, &tmo);
+	if (intvl <= 0) return -1;
+
+	if (!lastheard) lastheard = now;
+	if (pinged && pinged <= lastheard) pinged = 0;
+
+	if (pinged) {
+		if (now - pinged < tmo) return pinged + tmo - now;
+
+		fprintf(stderr, "no answer to ping for %d seconds; closing\n",
+			tmo);
+		exit(1);
+	}
+
+	if (now - lastheard < intvl) return lastheard + intvl - now;
+
+	write_wbsoc_ping();
+	pinged = now;
+	return tmo;
 }
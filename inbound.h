@@ -7,5 +7,11 @@
 #include "outstreams.h"
 
 /* Forwards stdin, interpreted as websocket frames, to the given socket as
- * unframed data, otherwise uninterpreted. */
-void fwrd_inbound_frames(int sock);
+ * unframed data, otherwise uninterpreted. Returns 0 if the client may send more
+ * frames, 'c' if it sent a close frame, or 'e' if it closed the stream. */
+int fwrd_inbound_frames(int sock);
+
+/* Pings the client if it has sent nothing for the pingintvl= time, and exits if
+ * it then sends nothing for the pongtmo= time. Returns the most seconds to wait
+ * before calling this again, or -1 if pings are off. */
+int wbsoc_keepalive(void);
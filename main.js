@@ -7,7 +7,26 @@ window["extended_macros"] = {}
 
 function Xsetpointermotion(set) {}
 
-function Xbell() {}
+/* Raises a desktop notification if the tab is in the background. The first
+   one asks the user for permission and is lost. */
+function desknotif(titl, body)
+{
+	if (!document.hidden || !window.Notification) return;
+
+	if (Notification.permission == 'default')
+		Notification.requestPermission();
+	if (Notification.permission != 'granted') return;
+
+	new Notification(titl || document.title, {body: body, tag: 'werm'});
+}
+
+function Xbell() { desknotif('', 'bell'); }
+
+function Xnotify(s, titoff, bodoff)
+{
+	desknotif(	titoff < 0 ? '' : deqtostring(s, titoff),
+			bodoff < 0 ? '' : deqtostring(s, bodoff));
+}
 
 function Xsetcolor(trm, pi, rgb) {/* no-op */}
 
@@ -591,6 +610,13 @@ function unlock_title()
 	set_title();
 }
 
+/* Tags the session so the attach page can list it with ?tag=k=v. An empty
+   value removes the tag. */
+function settag(k, v)
+{
+	signal('\\g' + k + '=' + v + '\n');
+}
+
 function set_title()
 {
 	var compons;
@@ -718,6 +744,13 @@ function display(s)
 			history.replaceState(
 				{}, '', '/?termid=' + termid);
 		}
+		else if (s.startsWith('\\@pong:')) {
+			signal('\\q');
+		}
+		else if (s.startsWith('\\@')) {
+			/* Messages this client doesn't use, such as \@echo:
+			   which is only sent if some client asks for it. */
+		}
 		else
 			pend_display.push(hex_val(1) * 16 + hex_val(2));
 
@@ -794,6 +827,23 @@ function display(s)
 	}, 2000);
 }
 
+/* Asks the user before opening a terminal URL with init=, which is typed into
+   a new session, since any site could link to one. init= is dropped from the
+   URL if the user does not accept it. */
+function confirm_init()
+{
+	var m = location.search.match(/[?&]init=([^&]*)/), txt;
+
+	if (!m) return;
+	try		{ txt = decodeURIComponent(m[1]); }
+	catch (e)	{ txt = m[1]; }
+	if (confirm('Type this into the new terminal?\n\n' + txt)) return;
+
+	history.replaceState(null, '', location.pathname
+		+ location.search.replace(/([?&])init=[^&]*&?/, '$1')
+				 .replace(/[?&]$/, ''));
+}
+
 function prepare_sock()
 {
 	sock = new WebSocket(
@@ -816,6 +866,14 @@ function prepare_sock()
 	};
 }
 
+/* Probes the round-trip time to the server, which times how long the reply
+   takes to be acknowledged, so it appears in the session list. */
+function latprobe()
+{
+	if (sock.readyState != WebSocket.OPEN) return;
+	signal('\\p\n');
+}
+
 function signal(s)
 {
 	var s;
@@ -1664,12 +1722,15 @@ window.onload = function()
 	term_canv();
 
 	host = location.host.replace(/^localhost:/, ':');
+	confirm_init();
 	prepare_sock();
 	params = new URLSearchParams(window.location.search);
 	termid = params.get('termid');
 	dead_key_hist = ['?', 'x', '?', 'x'];
 	display('');
 
+	window.setInterval(latprobe, 10000);
+
 	document.onkeydown = sporkeydown;
 	document.onkeyup = sporkeyup;
 	document.oncontextmenu = function(e) {	e.stopPropagation();
@@ -0,0 +1,144 @@
+/* Copyright 2026 Google LLC
+ *
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file or at
+ * https://developers.google.com/open-source/licenses/bsd */
+
+#include "metrics.h"
+
+#include <stdio.h>
+#include <string.h>
+#include <sys/mman.h>
+#include <unistd.h>
+
+struct metrics *metrics;
+struct conninfo *myconn;
+
+void metrics_init(void)
+{
+	void *m = mmap(0, sizeof(*metrics), PROT_READ | PROT_WRITE,
+		       MAP_SHARED | MAP_ANONYMOUS, -1, 0);
+
+	if (m == MAP_FAILED) { perror("mmap metrics"); return; }
+	metrics = m;
+}
+
+void metrics_claimconn(void)
+{
+	static struct conninfo local;
+	pid_t none;
+	int i;
+
+	myconn = &local;
+	local.pid = getpid();
+
+	for (i = 0; metrics && i < MAXCONNINFO; i++) {
+		none = 0;
+		if (!__atomic_compare_exchange_n(&metrics->conn[i].pid, &none,
+						 getpid(), 0, __ATOMIC_ACQUIRE,
+						 __ATOMIC_RELAXED))
+			continue;
+
+		myconn = metrics->conn + i;
+		break;
+	}
+
+	time(&myconn->start);
+}
+
+void metrics_releaseconn(pid_t pid)
+{
+	struct conninfo *c;
+
+	if (!metrics) return;
+
+	for (c = metrics->conn; c < metrics->conn + MAXCONNINFO; c++) {
+		if (c->pid != pid) continue;
+
+		memset((char *) c + sizeof(c->pid), 0,
+		       sizeof(*c) - sizeof(c->pid));
+		__atomic_store_n(&c->pid, 0, __ATOMIC_RELEASE);
+	}
+}
+
+static void metric(struct fdbuf *b, const char *nm, const char *type,
+		   const char *help, unsigned long long v)
+{
+	fdb_apnd(b, "# HELP ", -1);
+	fdb_apnd(b, nm, -1);
+	fdb_apnc(b, ' ');
+	fdb_apnd(b, help, -1);
+	fdb_apnd(b, "\n# TYPE ", -1);
+	fdb_apnd(b, nm, -1);
+	fdb_apnc(b, ' ');
+	fdb_apnd(b, type, -1);
+	fdb_apnc(b, '\n');
+	fdb_apnd(b, nm, -1);
+	fdb_apnc(b, ' ');
+	fdb_itoa(b, v);
+	fdb_apnc(b, '\n');
+}
+
+void metrics_write(struct fdbuf *b, const struct metrics *m)
+{
+	metric(b, "werm_connections_total", "counter",
+	       "Connections accepted.", m->conns);
+	metric(b, "werm_connections_active", "gauge",
+	       "Connections currently open.", m->active);
+	metric(b, "werm_connections_failed_total", "counter",
+	       "Connection processes which exited with an error.",
+	       m->failexits);
+	metric(b, "werm_connections_ratelimited_total", "counter",
+	       "Connections refused by the rate limit.", m->ratelimited);
+	metric(b, "werm_connections_overlimit_total", "counter",
+	       "Connections refused by a concurrent connection limit.",
+	       m->overlimit);
+	metric(b, "werm_websockets_total", "counter",
+	       "Websocket upgrades accepted.", m->websockets);
+	metric(b, "werm_bad_requests_total", "counter",
+	       "Requests rejected as malformed or not allowed.", m->badreqs);
+	metric(b, "werm_unauthorized_total", "counter",
+	       "Requests rejected for missing or wrong credentials.",
+	       m->unauthd);
+	metric(b, "werm_address_denied_total", "counter",
+	       "Requests rejected because of the client address.",
+	       m->addrdenied);
+	metric(b, "werm_websocket_received_bytes_total", "counter",
+	       "Websocket payload bytes received from clients.", m->bytesin);
+	metric(b, "werm_websocket_sent_bytes_total", "counter",
+	       "Websocket payload bytes sent to clients.", m->bytesout);
+	metric(b, "werm_websocket_received_messages_total", "counter",
+	       "Websocket frames received from clients.", m->msgsin);
+	metric(b, "werm_websocket_sent_messages_total", "counter",
+	       "Websocket frames sent to clients.", m->msgsout);
+}
+
+void test_metrics(void)
+{
+	struct wrides de = {1};
+	struct fdbuf b = {&de};
+	struct metrics m = {
+		.conns = 12, .active = 2, .failexits = 1, .ratelimited = 3,
+		.websockets = 5, .badreqs = 4, .unauthd = 2,
+		.bytesin = 1234567890123ull, .bytesout = 99, .msgsout = 7,
+	};
+
+	puts("METRICS");
+	metrics_write(&b, &m);
+	fdb_finsh(&b);
+
+	printf("shared before init: %d\n", !!metrics);
+	metrics_init();
+	METRIC_ADD(bytesout, 10);
+	METRIC_ADD(bytesout, 5);
+	printf("shared after init: %llu\n", metrics->bytesout);
+
+	metrics_claimconn();
+	TRAFFIC_ADD(bytesin, 3);
+	printf("claimed slot: %d, pid matches: %d, bytesin: %llu %llu\n",
+	       (int) (myconn - metrics->conn), myconn->pid == getpid(),
+	       myconn->bytesin, metrics->bytesin);
+	metrics_releaseconn(getpid());
+	printf("released: %d %llu\n", metrics->conn[0].pid, myconn->bytesin);
+	myconn = 0;
+}
@@ -0,0 +1,82 @@
+/* Copyright 2026 Google LLC
+ *
+ * Use of this source code is governed by a BSD-style
+ * license that can be found in the LICENSE file or at
+ * https://developers.google.com/open-source/licenses/bsd */
+
+#ifndef METRICS_H
+#define METRICS_H
+
+#include "outstreams.h"
+
+#include <sys/types.h>
+#include <time.h>
+
+/* An open websocket connection. pid is 0 if the slot is free. observer is set
+   if the client only observes the session. */
+struct conninfo {
+	pid_t pid;
+	time_t start;
+	char addr[64], user[64], termid[64];
+	unsigned observer : 1;
+	unsigned long long bytesin, bytesout, msgsin, msgsout;
+};
+
+#define MAXCONNINFO 256
+
+/* Counters shared by the spawner and the processes it forks for each
+   connection, so any of them can report totals for the whole server. */
+struct metrics {
+	/* Connections accepted and forked, those still open, and those whose
+	   process exited with an error. */
+	unsigned long conns, active, failexits;
+
+	/* Connections refused by the rate= and conns=/addrconns= listener
+	   options. */
+	unsigned long ratelimited, overlimit;
+
+	/* Requests which became websockets, or got an error response because
+	   they were malformed, lacked credentials, or came from a denied
+	   address. */
+	unsigned long websockets, badreqs, unauthd, addrdenied;
+
+	/* Websocket traffic, not counting frame headers. */
+	unsigned long long bytesin, bytesout, msgsin, msgsout;
+
+	struct conninfo conn[MAXCONNINFO];
+};
+
+/* Null unless metrics_init was called by this process or an ancestor. */
+extern struct metrics *metrics;
+
+#define METRIC_ADD(f, n) do {						\
+	if (metrics) __atomic_add_fetch(&metrics->f, (n), __ATOMIC_RELAXED);	\
+} while (0)
+
+/* The slot for the websocket connection served by this process, or null. */
+extern struct conninfo *myconn;
+
+/* Counts websocket traffic for the server and for this connection. */
+#define TRAFFIC_ADD(f, n) do {						\
+	METRIC_ADD(f, n);						\
+	if (myconn) myconn->f += (n);					\
+} while (0)
+
+/* Allocates the counters in memory which is shared with child processes
+   forked afterward. */
+void metrics_init(void);
+
+/* Appends the counters in m in the Prometheus text exposition format. */
+void metrics_write(struct fdbuf *b, const struct metrics *m);
+
+/* Takes a free slot for this process's websocket connection and sets myconn to
+   it. If metrics are not shared or all slots are taken, myconn points to memory
+   only this process sees, so the traffic can still be counted. */
+void metrics_claimconn(void);
+
+/* Frees the slot held by pid, which has exited. */
+void metrics_releaseconn(pid_t pid);
+
+void test_metrics(void);
+
+#endif
@@ -4,6 +4,7 @@
  * license that can be found in the LICENSE file or at
  * https://developers.google.com/open-source/licenses/bsd */
 
+#include <ctype.h>
 #include <limits.h>
 #include <err.h>
 #include <errno.h>
@@ -12,8 +13,12 @@
 #include <stdlib.h>
 #include <stdint.h>
 #include <sys/uio.h>
+#include <sys/socket.h>
+#include <sys/time.h>
 #include <arpa/inet.h>
+#include <zlib.h>
 
+#include "metrics.h"
 #include "outstreams.h"
 #include "shared.h"
 
@@ -74,7 +79,8 @@ static void fullwriannot(struct wrides *de, const unsigned char *br, size_t sz)
 		esc[1] = 0;
 
 		if (*esc == '\\') strcpy(esc, "\\\\");
-		else if (*esc < ' ') sprintf(esc, "\\%03o", *esc);
+		else if (br[-1] < ' ' || br[-1] >= 0x80)
+			sprintf(esc, "\\%03o", br[-1]);
 
 		fdb_apnd(&eb, esc, -1);
 	}
@@ -121,6 +127,82 @@ void fdb_routs(struct fdbuf *b, const char *s, ssize_t len)
 	while (len--) fdb_routc(b, *s++);
 }
 
+static int hexval(int c)
+{
+	if (c >= '0' && c <= '9') return c - '0';
+	if (c >= 'a' && c <= 'f') return c - 'a' + 10;
+	return -1;
+}
+
+/* Advances a terminal escape sequence parser by one byte. 0 means we are not in
+   the middle of an escape sequence. */
+static int tescstep(int st, int byt)
+{
+	if (byt == 033 && st != 's') return 'e';
+
+	switch (st) {
+	default: abort();
+	case 0:		return 0;
+	case 'e':
+		switch (byt) {
+		case '[':				return 'c';
+		case ']': case 'P': case '_': case '^':	return 's';
+		case '(': case ')': case '*': case '+':
+		case '#': case '%':			return 'g';
+		default:				return 0;
+		}
+	case 'c':	return byt >= 0x40 && byt <= 0x7e ? 0 : 'c';
+	case 'g':	return 0;
+
+	/* string, e.g. OSC, which ends with BEL or ESC \ */
+	case 's':	return byt == 007 ? 0 : byt == 033 ? 'S' : 's';
+	case 'S':	return byt == '\\' ? 0 : 's';
+	}
+}
+
+size_t rout_cutlen(const unsigned char *b, size_t len)
+{
+	const unsigned char *nl;
+	size_t i = 0, safe = 0;
+	int byt, hi, lo, utfn = 0, te = 0;
+
+	while (i < len) {
+		byt = -1;
+
+		if (b[i] != '\\') {
+			/* Unescaped newlines only separate chunks of output. */
+			if (b[i] != '\n') byt = b[i];
+			i++;
+		}
+		else if (i + 1 < len && b[i+1] == '@') {
+			nl = memchr(b + i, '\n', len - i);
+			if (!nl) break;
+			i = nl - b + 1;
+		}
+		else if (i + 2 < len) {
+			hi = hexval(b[i+1]);
+			lo = hexval(b[i+2]);
+			if (hi >= 0 && lo >= 0) byt = hi << 4 | lo;
+			i += 3;
+		}
+		else break;
+
+		if (byt >= 0) {
+			if (byt >= 0x80 && byt < 0xc0)	utfn -= !!utfn;
+			else if (byt >= 0xf0)		utfn = 3;
+			else if (byt >= 0xe0)		utfn = 2;
+			else if (byt >= 0xc0)		utfn = 1;
+			else				utfn = 0;
+
+			te = tescstep(te, byt);
+		}
+
+		if (!utfn && !te) safe = i;
+	}
+
+	return safe;
+}
+
 void fdb_json(struct fdbuf *b, const char *s, ssize_t len)
 {
 	int c;
@@ -141,6 +223,77 @@ void fdb_json(struct fdbuf *b, const char *s, ssize_t len)
 	fdb_apnc(b, '"');
 }
 
+static void apndutf8(struct fdbuf *b, unsigned long cp)
+{
+	if (cp < 0x80) { fdb_apnc(b, cp); return; }
+	if (cp < 0x800) {
+		fdb_apnc(b, 0xc0 | cp >> 6);
+	}
+	else if (cp < 0x10000) {
+		fdb_apnc(b, 0xe0 | cp >> 12);
+		fdb_apnc(b, 0x80 | (cp >> 6 & 0x3f));
+	}
+	else {
+		fdb_apnc(b, 0xf0 | cp >> 18);
+		fdb_apnc(b, 0x80 | (cp >> 12 & 0x3f));
+		fdb_apnc(b, 0x80 | (cp >> 6 & 0x3f));
+	}
+	fdb_apnc(b, 0x80 | (cp & 0x3f));
+}
+
+static int hex4(const char *s, unsigned long *cp)
+{
+	char h[5], *e;
+
+	memcpy(h, s, 4);
+	h[4] = 0;
+	*cp = strtoul(h, &e, 16);
+	return e == h + 4 && isxdigit((unsigned char) *h);
+}
+
+const char *fdb_unjson(struct fdbuf *b, const char *s)
+{
+	unsigned long cp, lo;
+
+	if (*s++ != '"') return 0;
+
+	for (;;) {
+		switch (*s) {
+		case 0:		return 0;
+		case '"':	return s + 1;
+		default:	fdb_apnc(b, *s++); continue;
+		case '\\':	break;
+		}
+
+		s++;
+		switch (*s++) {
+		case '"':	fdb_apnc(b, '"');	break;
+		case '\\':	fdb_apnc(b, '\\');	break;
+		case '/':	fdb_apnc(b, '/');	break;
+		case 'b':	fdb_apnc(b, '\b');	break;
+		case 'f':	fdb_apnc(b, '\f');	break;
+		case 'n':	fdb_apnc(b, '\n');	break;
+		case 'r':	fdb_apnc(b, '\r');	break;
+		case 't':	fdb_apnc(b, '\t');	break;
+		case 'u':
+			if (strnlen(s, 4) < 4 || !hex4(s, &cp)) return 0;
+			s += 4;
+
+			/* Combine a surrogate pair. */
+			if (cp >= 0xd800 && cp < 0xdc00 && s[0] == '\\'
+			    && s[1] == 'u' && strnlen(s + 2, 4) == 4
+			    && hex4(s + 2, &lo) && lo >= 0xdc00 && lo < 0xe000) {
+				cp = 0x10000 + ((cp - 0xd800) << 10)
+					+ (lo - 0xdc00);
+				s += 6;
+			}
+			apndutf8(b, cp);
+			break;
+		default:	return 0;
+		}
+	}
+}
+
 void fdb_itoa(struct fdbuf *b, long long i)
 {
 	char bf[sizeof(long long) * 4], *bc = bf;
@@ -175,6 +328,11 @@ void full_write(struct wrides *de, const void *buf_, ssize_t sz)
 	if (sz < 0) abort();
 	if (!sz) return;
 
+	if (de->into) {
+		fdb_apnd(de->into, buf_, sz);
+		return;
+	}
+
 	if (de->escannot) {
 		fullwriannot(de, buf_, sz);
 		return;
@@ -195,7 +353,25 @@ void full_write(struct wrides *de, const void *buf_, ssize_t sz)
 	} while (sz);
 }
 
-void write_wbsoc_frame(const void *buf, ssize_t len)
+/* Makes writes to the websocket fail once they have been blocked for wrtmo=
+   seconds. Without a timeout on the socket itself, a write could still block
+   indefinitely once the client takes a little of the output. */
+static void setwrtmo(void)
+{
+	static int done;
+	struct timeval tv = {0};
+
+	if (done) return;
+	done = 1;
+
+	tv.tv_sec = wbsoc_wrtmo();
+	if (tv.tv_sec <= 0) return;
+
+	if (0 > setsockopt(1, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv)))
+		perror("set websocket write timeout");
+}
+
+static void wbsocframe(int opcode, const void *buf, ssize_t len)
 {
 	unsigned char headr[14];
 	struct iovec v[2], *vc;
@@ -203,13 +379,8 @@ void write_wbsoc_frame(const void *buf, ssize_t len)
 	uint32_t len4;
 	ssize_t writn;
 
-	if (len < 0) len = strlen(buf);
-
-	/* Perhaps send a ping if len is 0? */
-	if (!len) return;
-
-	/* Send as a single text data frame. */
-	headr[0] = 0x81;
+	/* Send as a single frame with FIN set. */
+	headr[0] = 0x80 | opcode;
 
 	v[0].iov_base = headr;
 	if (len <= 125) {
@@ -236,13 +407,16 @@ void write_wbsoc_frame(const void *buf, ssize_t len)
 
 	vc = v;
 
-	writn = 0;
+	setwrtmo();
 	for (;;) {
-		vc->iov_len -= writn;
-
 		writn = writev(1, vc, v+2 - vc);
 		if (writn < 0) {
-			if (writn == EINTR) continue;
+			if (errno == EINTR) continue;
+			if (errno == EAGAIN || errno == EWOULDBLOCK) {
+				fprintf(stderr, "websocket write blocked for %d"
+					" seconds; closing\n", wbsoc_wrtmo());
+				exit(1);
+			}
 			perror("writev websocket frame");
 			abort();
 		}
@@ -252,9 +426,77 @@ void write_wbsoc_frame(const void *buf, ssize_t len)
 			writn -= vc->iov_len;
 			if (++vc == v + 2) return;
 		}
+		vc->iov_base = (char *) vc->iov_base + writn;
+		vc->iov_len -= writn;
 	}
 }
 
+static z_stream defl;
+static int deflon, deflreset;
+
+void wbsoc_deflate(int level, int wbits, int reset)
+{
+	if (Z_OK != deflateInit2(&defl, level, Z_DEFLATED, -(wbits ? wbits : 15),
+				 8, Z_DEFAULT_STRATEGY))
+		errx(1, "deflateInit2 failed");
+
+	deflon = 1;
+	deflreset = reset;
+}
+
+/* Compresses a message as RFC 7692 describes, appending it to z. */
+static void deflmsg(struct fdbuf *z, const void *buf, size_t len)
+{
+	unsigned char chunk[1024];
+
+	defl.next_in = (void *) buf;
+	defl.avail_in = len;
+	do {
+		defl.next_out = chunk;
+		defl.avail_out = sizeof(chunk);
+		if (Z_STREAM_ERROR == deflate(&defl, Z_SYNC_FLUSH)) abort();
+		fdb_apnd(z, chunk, sizeof(chunk) - defl.avail_out);
+	}
+	while (!defl.avail_out);
+
+	/* The flush ends with an empty block, 00 00 ff ff, which the client
+	   adds back before decompressing. */
+	z->len -= 4;
+
+	if (deflreset) deflateReset(&defl);
+}
+
+void write_wbsoc_frame(const void *buf, ssize_t len)
+{
+	struct fdbuf z = {0};
+
+	if (len < 0) len = strlen(buf);
+
+	/* Perhaps send a ping if len is 0? */
+	if (!len) return;
+
+	if (deflon) {
+		deflmsg(&z, buf, len);
+		buf = z.bf;
+		len = z.len;
+	}
+
+	/* RSV1 marks a compressed message. */
+	wbsocframe(deflon ? 0x41 : 0x1, buf, len);
+	TRAFFIC_ADD(bytesout, len);
+	TRAFFIC_ADD(msgsout, 1);
+	fdb_finsh(&z);
+}
+
+void write_wbsoc_ping(void) { wbsocframe(0x9, "", 0); }
+
+void write_wbsoc_close(unsigned code)
+{
+	uint16_t ncode = htons(code);
+
+	wbsocframe(0x8, &ncode, sizeof(ncode));
+}
+
 void _Noreturn exit_msg(const char *flags, const char *msg, int code)
 {
 	struct fdbuf b = {0};
@@ -275,6 +517,7 @@ void _Noreturn exit_msg(const char *flags, const char *msg, int code)
 	fdb_apnc(&b, '\n');
 
 	write_wbsoc_frame(b.bf, b.len);
+	write_wbsoc_close(iserr ? 1011 : 1000);
 	exit(iserr);
 }
 
@@ -283,6 +526,34 @@ void test_outstreams(void)
 	struct wrides de = {1};
 	struct fdbuf b = {&de, 32};
 	int i;
+	const char *cuts[] = {
+		"abc\\0a",
+		"abc\\0",
+		"abc\\",
+		"x\\e3\\81\\82y",
+		"x\\e3\\81",
+		"x\\e3\\81\\8",
+		"ok\\@title:foo\nbar",
+		"ok\\@title:fo",
+		"a\\1b[1;3",
+		"a\\1b[1;35mb",
+		"a\\1b]0;title\\07b",
+		"a\\1b]0;tit",
+		"a\\1b]0;title\\1b\\5cb",
+		"a\\1b(",
+		"a\\1b(Bc",
+		"\\1b\\1b[A\n",
+		"\\s2",
+	};
+	const char *jsons[] = {
+		"\"plain\" trailing",
+		"\"esc \\\"\\\\\\/\\t|\\u0041\\u001b[1m\"",
+		"\"\\u00e9\\u20ac\\ud83d\\ude00\"",
+		"\"unterminated",
+		"\"bad \\x\"",
+		"\"short \\u12\"",
+		"no quote",
+	}, *end;
 
 	printf("TEST OUTSTREAMS\n");
 	fdb_apnd(&b, "hello\n", -1);
@@ -339,4 +610,22 @@ void test_outstreams(void)
 	b.cap = 16;
 	for (i = 0; i < 50; i++) fdb_apnd(&b, i & 1 ? "abc" : "123", i % 3);
 	fdb_finsh(&b);
+
+	printf("TEST FDB_UNJSON\n");
+	de.escannot = "unjson";
+	b.cap = 0;
+	for (i = 0; i < sizeof(jsons) / sizeof(*jsons); i++) {
+		end = fdb_unjson(&b, jsons[i]);
+		printf("%d ", end ? (int) (end - jsons[i]) : -1);
+		fdb_apnc(&b, '\n');
+		fdb_finsh(&b);
+	}
+
+	printf("TEST ROUT_CUTLEN\n");
+	de.escannot = "rout";
+	for (i = 0; i < sizeof(cuts) / sizeof(*cuts); i++) {
+		printf("%zu ", rout_cutlen((const unsigned char *) cuts[i],
+					   strlen(cuts[i])));
+		full_write(&de, cuts[i], -1);
+	}
 }
@@ -23,6 +23,10 @@ struct wrides {
 	 * Intended for more readable test output.
 	 */
 	const char *escannot;
+
+	/* If non-null, writes are appended to this buffer rather than the fd,
+	 * e.g. to queue them behind other output. */
+	struct fdbuf *into;
 };
 
 /* Comprises a file descriptor and a buffer which is pending a write to it.
@@ -57,12 +61,23 @@ void fdb_routc(struct fdbuf *b, int c);
  * Will escape as needed like fdb_routc does. */
 void fdb_routs(struct fdbuf *b, const char *s, ssize_t len);
 
+/* Returns how many bytes at the start of buf, which holds client output as
+   produced by fdb_routc and \@ messages, can be sent to the client without
+   splitting an escape, a UTF-8 sequence, or a terminal escape sequence. The
+   remaining bytes should be held until more output arrives. */
+size_t rout_cutlen(const unsigned char *buf, size_t len);
+
 /* Appends the given string as a JSON string. The string in |s| is a utf8
    string, and non-ASCII codepoints are not modified, so the output is also
    utf8. Where escapes are needed, \u is used rather than \x so that the results
    can be parsed as JSON. */
 void fdb_json(struct fdbuf *b, const char *s, ssize_t len);
 
+/* Decodes the JSON string at s, which starts with a quote, and appends it to b
+   as UTF-8. Returns a pointer past the closing quote, or null if the string is
+   malformed, in which case part of it may have been appended. */
+const char *fdb_unjson(struct fdbuf *b, const char *s);
+
 /* Converts a number to a string and appends it to b. Escaping is not necessary
    if this is used for terminal output to the client. */
 void fdb_itoa(struct fdbuf *b, long long i);
@@ -74,7 +89,20 @@ void full_write(struct wrides *de, const void *buf_, ssize_t len);
 /* Writes data in buffer as a websocket data frame to stdout. */
 void write_wbsoc_frame(const void *buf, ssize_t len);
 
-/* Formats and escapes a message for output to stdout as websocket data.
+/* Compresses the websocket data frames written after this with
+ * permessage-deflate. level is the zlib compression level, wbits is the window
+ * size in bits, or 0 for the largest, and if reset is set, each message is
+ * compressed without the context of earlier ones. */
+void wbsoc_deflate(int level, int wbits, int reset);
+
+/* Writes a websocket ping frame to stdout. */
+void write_wbsoc_ping(void);
+
+/* Writes a websocket close frame with the given status code to stdout. */
+void write_wbsoc_close(unsigned code);
+
+/* Formats and escapes a message for output to stdout as websocket data, then
+ * sends a close frame and exits.
  * code is concatenated on the end of the message, if it is not -1.
  * flags can be any number of these characters in a string:
  * "s" - include dtach_socket value
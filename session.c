@@ -8,10 +8,13 @@
 #include "shared.h"
 #include "font.h"
 #include "outstreams.h"
+#include "inbound.h"
 #include "test/raw/data.h"
 #include <md4c-html.h>
 #include "wts.h"
 #include "http.h"
+#include "auth.h"
+#include "metrics.h"
 #include "spawner.h"
 #include "dtachctx.h"
 #include "tm.c"
@@ -32,13 +35,51 @@
 #include <sys/types.h>
 #include <stdlib.h>
 #include <fcntl.h>
+#include <sys/file.h>
 #include <sys/ioctl.h>
+#include <termios.h>
+#include <signal.h>
 #include <err.h>
 #include <stdarg.h>
 #include <dirent.h>
-
-static char *argv0, *termid, *logview, *sblvl, *dtachlog;
+#include <sys/socket.h>
+#include <netinet/in.h>
+#include <arpa/inet.h>
+
+static char *argv0, *termid, *logview, *sblvl, *dtachlog, *cliclose;
+static char *maxhdrs, *maxhdrbytes, *hdrtmo, *wrtmo, *nullorigin, *noorigin;
+static char *tcpkeepalive, *tcpkeepintvl, *tcpkeepcnt, *exitwait;
+static char *latwarn, *detachtmo, *idletmo, *motd, *htpasswd, *usercap;
+static char *authtoken, *authtokenfile, *token, *authcmd, *authcmdcode;
+static char *allowip, *denyip, *trustproxy, *metricspath, *adminpath;
+static char *adminusers, *onconnect, *ondisconnect, *castdir, *play, *speed;
+static char *observers, *observe, *deflvl, *deflctx, *protocols;
+static char *pingintvl, *pongtmo, *maxmsg, *slowcli, *maxoutbuf;
+static char *accesslog, *accesslogmax, *accesslogkeep, *initinput, *init;
 static const char *qs;
+static int badflags, fromcli;
+
+/* Settings which websocket clients may give in their query args. They only
+   apply to that connection or the session it starts. Other settings in a
+   client's query string are ignored, since they would let any client change
+   how the server runs, e.g. which programs it starts or files it writes. */
+static char **const cliargs[] = {
+	&termid, &logview, &sblvl, &dtachlog, &cliclose, &token, &play, &speed,
+	&observe, &init, 0,
+};
+
+/* Settings which the spawner can change by reloading them. The others are
+   used once at startup or are per-session. */
+static char **const reloadable[] = {
+	&sblvl, &cliclose, &maxhdrs, &maxhdrbytes, &hdrtmo, &wrtmo,
+	&nullorigin, &noorigin, &exitwait, &latwarn, &detachtmo, &idletmo,
+	&motd, &htpasswd, &authtoken, &authtokenfile, &authcmd, &authcmdcode,
+	&allowip, &denyip, &trustproxy, &metricspath, &adminpath,
+	&adminusers, &onconnect, &ondisconnect, &castdir, &observers,
+	&deflvl, &deflctx, &protocols, &pingintvl, &pongtmo, &maxmsg,
+	&slowcli, &maxoutbuf, &accesslog, &accesslogmax, &accesslogkeep,
+	&initinput, &usercap, 0,
+};
 
 static size_t argv0sz;
 
@@ -59,10 +100,23 @@ static void TMpokettl(int toff, int b)
 
 void Xsetcolor(int trm, int pi, int rgb) {/* no-op */}
 
+void Xbell(int trm) { wts.bell = 1; }
+
+/* Keep the title so the attach page can show it. A null deq restores the
+   default title. */
+void Xsettitle(TMint deq, TMint off)
+{
+	if (deq)	strncpy(wts.osctitl, deqtostring(deq, off),
+				sizeof(wts.osctitl) - 1);
+	else		*wts.osctitl = 0;
+}
+
+/* Flag the session like a bell so the attach page shows it needs attention.
+   The browser raises the notification itself. */
+void Xnotify(TMint deq, TMint titoff, TMint bodoff) { wts.bell = 1; }
+
 /* No-ops because server is headless */
 void Xicontitl(TMint deq, TMint off)					{}
-void Xsettitle(TMint deq, TMint off)					{}
-void Xbell(int trm)							{}
 void Xsetpointermotion(int set)						{}
 void Xdrawglyph(int trm, int gf, int x, int y)				{}
 void Xosc52copy(TMint trm, TMint deq, TMint byti)			{}
@@ -84,6 +138,67 @@ void Ttywriteraw(int trm, int dq, int of, int sz)
 	fdb_routs(&therout, deqtostring(dq, of), sz);
 }
 
+/* Returns how many bytes at the start of b can be written without ending in
+   the middle of a UTF-8 character. */
+static size_t utf8cut(const char *b, size_t len)
+{
+	unsigned char c;
+	size_t i, need;
+
+	for (i = 1; i <= 3 && i <= len; i++) {
+		c = b[len - i];
+		if ((c & 0xc0) == 0x80) continue;
+
+		need = c >= 0xf0 ? 4 : c >= 0xe0 ? 3 : c >= 0xc0 ? 2 : 1;
+		return need > i ? len - i : len;
+	}
+	return len;
+}
+
+/* Appends an event to the asciicast recording, t seconds after it started.
+   Each event must be a valid JSON string, so output which ends in the middle of
+   a UTF-8 character is held until the rest arrives. */
+static void castevent(double t, char kind, const char *s, size_t len)
+{
+	struct fdbuf b = {&wts.castde}, d = {0};
+	char ts[48];
+
+	if (kind == 'o') {
+		fdb_apnd(&d, wts.casthold, wts.castholdn);
+		fdb_apnd(&d, s, len);
+		s = (char *) d.bf;
+		len = utf8cut(s, d.len);
+		wts.castholdn = d.len - len;
+		memcpy(wts.casthold, s + len, wts.castholdn);
+	}
+
+	if (len) {
+		snprintf(ts, sizeof(ts), "[%.6f, \"%c\", ", t, kind);
+		fdb_apnd(&b, ts, -1);
+		fdb_json(&b, s, len);
+		fdb_apnd(&b, "]\n", -1);
+		fdb_finsh(&b);
+	}
+	fdb_finsh(&d);
+}
+
+static double castsecs(void)
+{
+	struct timespec now;
+
+	clock_gettime(CLOCK_MONOTONIC, &now);
+	return now.tv_sec - wts.castt0.tv_sec
+		+ (now.tv_nsec - wts.castt0.tv_nsec) / 1e9;
+}
+
+long long msnow(void)
+{
+	struct timespec now;
+
+	clock_gettime(CLOCK_MONOTONIC, &now);
+	return now.tv_sec * 1000LL + now.tv_nsec / 1000000;
+}
+
 struct fdbuf therout;
 void process_tty_out(void *buf, ssize_t len)
 {
@@ -93,6 +208,7 @@ void process_tty_out(void *buf, ssize_t len)
 	if (len < 0) len = strlen(buf);
 
 	if (wts.writerawlg) full_write(&wts.rawlogde, buf, len);
+	if (wts.writecast) castevent(castsecs(), 'o', buf, len);
 
 	if (!wts.t) {
 		wts.t = term_new();
@@ -125,6 +241,37 @@ static void recounttitl(struct wrides *de)
 	fdb_finsh(&b);
 }
 
+/* Returns whether echo is on for the given pty, assuming it is if unknown. */
+static int ptyecho(int fd)
+{
+	struct termios tio;
+
+	return tcgetattr(fd, &tio) || (tio.c_lflag & ECHO);
+}
+
+static void echohint(struct fdbuf *b)
+{
+	fdb_apnd(b, wts.echoff ? "\\@echo:0\n" : "\\@echo:1\n", -1);
+}
+
+void snoop_echo(int ptyfd)
+{
+	unsigned off = !ptyecho(ptyfd);
+
+	if (!wts.echohint || off == wts.echoff) return;
+
+	wts.echoff = off;
+	echohint(&therout);
+}
+
+static int isclientarg(char **dest)
+{
+	char **const *a;
+
+	for (a = cliargs; *a; a++) if (*a == dest) return 1;
+	return 0;
+}
+
 static int parsequeryarg(const char *pref, char **dest)
 {
 	size_t preflen;
@@ -138,6 +285,12 @@ static int parsequeryarg(const char *pref, char **dest)
 
 	end = strchrnul(qs, '&');
 
+	if (fromcli && !isclientarg(dest)) {
+		fprintf(stderr, "ignoring %s from client query string\n", pref);
+		qs = end;
+		return 1;
+	}
+
 	free(*dest);
 	dscur = *dest = malloc(end - qs + 1);
 
@@ -159,6 +312,30 @@ static int parsequeryarg(const char *pref, char **dest)
 
 int dtach_logging(void) { return !!dtachlog; }
 
+int wbsoc_wrtmo(void) { return wrtmo ? atoi(wrtmo) : 0; }
+
+long long wbsoc_maxmsg(void) { return maxmsg ? atoll(maxmsg) : 0; }
+
+void slowcli_policy(size_t *maxbuf, int *drop)
+{
+	*maxbuf	= maxoutbuf	? strtoull(maxoutbuf, 0, 10)	: 65536;
+	*drop	= !slowcli	|| strcmp(slowcli, "block");
+}
+
+void wbsoc_pings(int *intvl, int *tmo)
+{
+	*intvl	= pingintvl	? atoi(pingintvl)	: 0;
+	*tmo	= pongtmo	? atoi(pongtmo)		: 0;
+	if (*tmo <= 0) *tmo = *intvl;
+}
+
+void tcp_keepalive_dflt(int *idle, int *intvl, int *cnt)
+{
+	*idle	= tcpkeepalive	? atoi(tcpkeepalive)	: 0;
+	*intvl	= tcpkeepintvl	? atoi(tcpkeepintvl)	: 0;
+	*cnt	= tcpkeepcnt	? atoi(tcpkeepcnt)	: 0;
+}
+
 #define ILLEGALTERMIDCHARS "&?+% =/\\\"<>"
 
 static void checktid(void)
@@ -183,15 +360,322 @@ static void processquerystr(const char *fullqs)
 		if (parsequeryarg("logview=",	&logview	)) continue;
 		if (parsequeryarg("sblvl=",	&sblvl		)) continue;
 		if (parsequeryarg("dtachlog=",	&dtachlog	)) continue;
+		if (parsequeryarg("cliclose=",	&cliclose	)) continue;
+		if (parsequeryarg("maxhdrs=",	&maxhdrs	)) continue;
+		if (parsequeryarg("maxhdrbytes=", &maxhdrbytes	)) continue;
+		if (parsequeryarg("hdrtmo=",	&hdrtmo		)) continue;
+		if (parsequeryarg("wrtmo=",	&wrtmo		)) continue;
+		if (parsequeryarg("nullorigin=", &nullorigin	)) continue;
+		if (parsequeryarg("noorigin=",	&noorigin	)) continue;
+		if (parsequeryarg("tcpkeepalive=", &tcpkeepalive)) continue;
+		if (parsequeryarg("tcpkeepintvl=", &tcpkeepintvl)) continue;
+		if (parsequeryarg("tcpkeepcnt=", &tcpkeepcnt	)) continue;
+		if (parsequeryarg("exitwait=",	&exitwait	)) continue;
+		if (parsequeryarg("latwarn=",	&latwarn	)) continue;
+		if (parsequeryarg("detachtmo=",	&detachtmo	)) continue;
+		if (parsequeryarg("idletmo=",	&idletmo	)) continue;
+		if (parsequeryarg("usercap=",	&usercap	)) continue;
+		if (parsequeryarg("motd=",	&motd		)) continue;
+		if (parsequeryarg("htpasswd=",	&htpasswd	)) continue;
+		if (parsequeryarg("authtoken=",	&authtoken	)) continue;
+		if (parsequeryarg("authtokenfile=", &authtokenfile)) continue;
+		if (parsequeryarg("authcmd=",	&authcmd	)) continue;
+		if (parsequeryarg("authcmdcode=", &authcmdcode	)) continue;
+		if (parsequeryarg("allowip=",	&allowip	)) continue;
+		if (parsequeryarg("denyip=",	&denyip		)) continue;
+		if (parsequeryarg("trustproxy=", &trustproxy	)) continue;
+		if (parsequeryarg("metrics=",	&metricspath	)) continue;
+		if (parsequeryarg("admin=",	&adminpath	)) continue;
+		if (parsequeryarg("adminusers=", &adminusers	)) continue;
+		if (parsequeryarg("onconnect=",	&onconnect	)) continue;
+		if (parsequeryarg("ondisconnect=", &ondisconnect)) continue;
+		if (parsequeryarg("castdir=",	&castdir	)) continue;
+		if (parsequeryarg("play=",	&play		)) continue;
+		if (parsequeryarg("speed=",	&speed		)) continue;
+		if (parsequeryarg("observers=",	&observers	)) continue;
+		if (parsequeryarg("observe=",	&observe	)) continue;
+		if (parsequeryarg("deflate=",	&deflvl		)) continue;
+		if (parsequeryarg("deflatectx=", &deflctx	)) continue;
+		if (parsequeryarg("protocols=",	&protocols	)) continue;
+		if (parsequeryarg("pingintvl=",	&pingintvl	)) continue;
+		if (parsequeryarg("pongtmo=",	&pongtmo	)) continue;
+		if (parsequeryarg("maxmsg=",	&maxmsg		)) continue;
+		if (parsequeryarg("slowcli=",	&slowcli	)) continue;
+		if (parsequeryarg("maxoutbuf=",	&maxoutbuf	)) continue;
+		if (parsequeryarg("accesslog=",	&accesslog	)) continue;
+		if (parsequeryarg("accesslogmax=", &accesslogmax)) continue;
+		if (parsequeryarg("accesslogkeep=", &accesslogkeep)) continue;
+		if (parsequeryarg("initinput=",	&initinput	)) continue;
+		if (parsequeryarg("init=",	&init		)) continue;
+
+		/* Checked by http_read_req, and ignored here. */
+		if (parsequeryarg("token=",	&token		)) continue;
 
 		fprintf(stderr,
 			"invalid query string arg at char pos %zu in '%s'\n",
 			qs - fullqs, fullqs);
+		badflags++;
 
 		qs = strchrnul(qs, '&');
 	}
 }
 
+/* Processes the query string of a websocket client, which may only give the
+   settings in cliargs. */
+static void processcliqs(const char *fullqs)
+{
+	fromcli = 1;
+	processquerystr(fullqs);
+	fromcli = 0;
+}
+
+/* Processes WERMFLAGS args read from f, one per line. Blank lines and lines
+   starting with # are ignored. */
+static void processflagsfile(FILE *f)
+{
+	struct fdbuf b = {0};
+	char ln[4096];
+	const char *a;
+
+	while (fgets(ln, sizeof(ln), f)) {
+		ln[strcspn(ln, "\r\n")] = 0;
+		for (a = ln; *a == ' ' || *a == '\t'; a++) {}
+		if (!*a || *a == '#') continue;
+
+		fdb_apnd(&b, a, -1);
+		fdb_apnc(&b, '&');
+	}
+
+	fdb_apnc(&b, 0);
+	processquerystr((char *) b.bf);
+	fdb_finsh(&b);
+}
+
+/* Processes the settings in the file named by WERMFLAGSFILE, if any. Returns 0
+   if it cannot be read. */
+static int loadflagsfile(void)
+{
+	const char *fn = getenv("WERMFLAGSFILE");
+	FILE *f;
+
+	if (!fn) return 1;
+	if (!(f = fopen(fn, "r"))) {
+		warn("open WERMFLAGSFILE %s", fn);
+		return 0;
+	}
+
+	processflagsfile(f);
+	fclose(f);
+	return 1;
+}
+
+static int checkcidrs(const char *nm, const char *cidrs)
+{
+	if (!cidrs || cidrsvalid(cidrs)) return 1;
+	warnx("%s=%s: invalid CIDR list", nm, cidrs);
+	return 0;
+}
+
+/* Returns whether the address lists are valid. An invalid entry would
+   otherwise be skipped, so a typo in denyip= would let everyone in. */
+static int cidrsok(void)
+{
+	int ok = 1;
+
+	ok &= checkcidrs("allowip",	allowip);
+	ok &= checkcidrs("denyip",	denyip);
+	ok &= checkcidrs("trustproxy",	trustproxy);
+	return ok;
+}
+
+void reload_flags(void)
+{
+	const char *fn = getenv("WERMFLAGSFILE");
+	FILE *f = fn ? fopen(fn, "r") : 0;
+	char *old[sizeof(reloadable) / sizeof(*reloadable)];
+	int i;
+
+	if (fn && !f) {
+		warn("not reloading: open WERMFLAGSFILE %s", fn);
+		return;
+	}
+
+	for (i = 0; reloadable[i]; i++) {
+		old[i] = *reloadable[i];
+		*reloadable[i] = 0;
+	}
+
+	if (f) {
+		processflagsfile(f);
+		fclose(f);
+	}
+	processquerystr(getenv("WERMFLAGS"));
+
+	if (!cidrsok()) {
+		for (i = 0; reloadable[i]; i++) {
+			free(*reloadable[i]);
+			*reloadable[i] = old[i];
+		}
+		warnx("not reloading: invalid settings");
+		return;
+	}
+
+	for (i = 0; reloadable[i]; i++) free(old[i]);
+	fprintf(stderr, "reloaded settings\n");
+}
+
+/* Appends s to b with quotes, backslashes, and control characters escaped, so
+   each access log line can be split reliably. */
+static void logstr(struct fdbuf *b, const char *s, ssize_t len)
+{
+	const char *end = s + (len < 0 ? strlen(s) : len);
+	char esc[5];
+
+	for (; s != end; s++) {
+		if (*s == '"' || *s == '\\' || (unsigned char) *s < ' '
+		    || *s == 0x7f) {
+			snprintf(esc, sizeof(esc), "\\x%02x", (unsigned char) *s);
+			fdb_apnd(b, esc, -1);
+		}
+		else
+			fdb_apnc(b, *s);
+	}
+}
+
+/* Formats a line for the access log in the Common Log Format, with the value
+   of any token= query arg hidden. If tr is given, the line is for the end of a
+   websocket connection: the size is the bytes sent, followed by the bytes and
+   messages in each direction and how many seconds it was open. */
+static void fmtaccess(struct fdbuf *b, Httpreq *rq, int code, time_t t,
+		      const struct conninfo *tr)
+{
+	struct tm tim;
+	char ts[64];
+	const char *q, *e;
+
+	if (!localtime_r(&t, &tim)) *ts = 0;
+	else strftime(ts, sizeof(ts), "%d/%b/%Y:%H:%M:%S %z", &tim);
+
+	logstr(b, rq->addr, -1);
+	fdb_apnd(b, " - ", -1);
+	logstr(b, *rq->user ? rq->user : "-", -1);
+	fdb_apnd(b, " [", -1);
+	fdb_apnd(b, ts, -1);
+	fdb_apnd(b, "] \"", -1);
+	fdb_apnd(b, rq->head ? "HEAD " : rq->del ? "DELETE " : "GET ", -1);
+	logstr(b, rq->resource, -1);
+
+	for (q = rq->query; *q; q = e + !!*e) {
+		e = strchrnul(q, '&');
+		fdb_apnc(b, q == rq->query ? '?' : '&');
+		if (strncmp(q, "token=", 6))	logstr(b, q, e - q);
+		else				fdb_apnd(b, "token=-", -1);
+	}
+
+	fdb_apnd(b, " HTTP/1.1\" ", -1);
+	if (code)	fdb_itoa(b, code);
+	else		fdb_apnc(b, '-');
+
+	if (!tr) { fdb_apnd(b, " -\n", -1); return; }
+
+	fdb_apnc(b, ' ');
+	fdb_itoa(b, tr->bytesout);
+	fdb_apnd(b, " in=", -1);
+	fdb_itoa(b, tr->bytesin);
+	fdb_apnd(b, " msgsout=", -1);
+	fdb_itoa(b, tr->msgsout);
+	fdb_apnd(b, " msgsin=", -1);
+	fdb_itoa(b, tr->msgsin);
+	fdb_apnd(b, " secs=", -1);
+	fdb_itoa(b, t - tr->start);
+	fdb_apnc(b, '\n');
+}
+
+/* Sets $QUERY_STRING for a hook or authcmd= to query, with the value of
+   token= hidden as in the access log. */
+static void setqsenv(const char *query)
+{
+	struct fdbuf b = {0};
+	const char *q, *e;
+
+	for (q = query; *q; q = e + !!*e) {
+		e = strchrnul(q, '&');
+		if (q != query) fdb_apnc(&b, '&');
+		if (strncmp(q, "token=", 6))	fdb_apnd(&b, q, e - q);
+		else				fdb_apnd(&b, "token=-", -1);
+	}
+	fdb_apnc(&b, 0);
+	setenv("QUERY_STRING", (char *) b.bf, 1);
+	fdb_finsh(&b);
+}
+
+/* Renames the access log to .1, .1 to .2, and so on, removing the oldest. */
+static void rotateaccess(void)
+{
+	int keep = accesslogkeep ? atoi(accesslogkeep) : 5, i;
+	char *from = 0, *to = 0;
+
+	if (keep <= 0) { unlink(accesslog); return; }
+
+	for (i = keep; i > 0; i--) {
+		if (i > 1)	xasprintf(&from, "%s.%d", accesslog, i - 1);
+		else		xasprintf(&from, "%s", accesslog);
+		xasprintf(&to, "%s.%d", accesslog, i);
+
+		if (0 > rename(from, to) && errno != ENOENT)
+			perror("rotate access log");
+
+		free(from);
+		free(to);
+		from = to = 0;
+	}
+}
+
+/* Returns whether fd is still open to the file named by accesslog. */
+static int islogfile(int fd)
+{
+	struct stat opn, cur;
+
+	if (fstat(fd, &opn)) return 1;
+	if (stat(accesslog, &cur)) return errno != ENOENT;
+	return opn.st_ino == cur.st_ino && opn.st_dev == cur.st_dev;
+}
+
+/* Appends a line about the request to the access log, if there is one. tr is
+   the traffic of a websocket connection which is closing, or null. The file is
+   opened for each line, so it can be moved by other tools at any time. The
+   processes serving each connection take turns with a lock. */
+static void logaccess(Httpreq *rq, const struct conninfo *tr)
+{
+	struct fdbuf b = {0};
+	struct stat sb;
+	int fd;
+	long max = accesslogmax ? atol(accesslogmax) : 0;
+
+	if (!accesslog) return;
+
+	/* Another process may rotate the log while this one waits for the
+	   lock. Then open the new file, so the line is not written to the old
+	   one, which would be rotated again. */
+	while (1) {
+		fd = open(accesslog, O_WRONLY | O_APPEND | O_CREAT | O_CLOEXEC,
+			  0600);
+		if (0 > fd) { perror("open access log"); return; }
+
+		if (0 > flock(fd, LOCK_EX)) perror("lock access log");
+		if (islogfile(fd)) break;
+		close(fd);
+	}
+
+	fmtaccess(&b, rq, rq->validws ? 101 : resp_lastcode(), time(0), tr);
+
+	full_write(&(struct wrides){fd}, b.bf, b.len);
+	if (max > 0 && !fstat(fd, &sb) && sb.st_size >= max) rotateaccess();
+
+	close(fd);
+	fdb_finsh(&b);
+}
+
 static void cdhome(void)
 {
 	const char *home;
@@ -202,8 +686,132 @@ static void cdhome(void)
 	else if (-1 == chdir(home)) warn("chdir to home: '%s'", home);
 }
 
+static void motdlimit(FILE *out, int secs)
+{
+	if (secs > 0)	fprintf(out, "%ds", secs);
+	else		fputs("none", out);
+}
+
+/* Copies a banner template to out, replacing {host}, {session}, {user},
+   {detachtmo} and {idletmo} with their values. Other text in braces is copied
+   as-is. */
+static void printmotd(FILE *in, FILE *out, Dtachctx dc)
+{
+	char nm[16], host[256];
+	int c, nml;
+	const char *user;
+
+	while (EOF != (c = fgetc(in))) {
+		if (c != '{') { fputc(c, out); continue; }
+
+		nml = 0;
+		while (EOF != (c = fgetc(in)) && c != '}' && c != '\n'
+		       && nml < sizeof(nm) - 1)
+			nm[nml++] = c;
+		nm[nml] = 0;
+
+		if (c != '}') {
+			fprintf(out, "{%s", nm);
+			if (c != EOF) ungetc(c, in);
+		}
+		else if (!strcmp(nm, "host")) {
+			if (gethostname(host, sizeof(host))) *host = 0;
+			host[sizeof(host) - 1] = 0;
+			fputs(host, out);
+		}
+		else if (!strcmp(nm, "session"))
+			fputs(termid ? termid : "", out);
+		else if (!strcmp(nm, "user")) {
+			user = getenv("REMOTE_USER");
+			if (!user) user = getenv("USER");
+			fputs(user ? user : "", out);
+		}
+		else if (!strcmp(nm, "detachtmo"))	motdlimit(out, dc->detachtmo);
+		else if (!strcmp(nm, "idletmo"))	motdlimit(out, dc->idletmo);
+		else					fprintf(out, "{%s}", nm);
+	}
+}
+
+/* Returns the name in dir made of digits which sorts last, but before bef if it
+   is given, or null if there is none. */
+static char *lastnumdir(const char *dir, const char *bef)
+{
+	DIR *d;
+	struct dirent *e;
+	char *best = 0;
+
+	if (!(d = opendir(dir))) return 0;
+	while ((e = readdir(d))) {
+		if (!*e->d_name)					continue;
+		if (e->d_name[strspn(e->d_name, "0123456789")])		continue;
+		if (bef && strcmp(e->d_name, bef) >= 0)			continue;
+		if (best && strcmp(e->d_name, best) <= 0)		continue;
+		free(best);
+		best = strdup(e->d_name);
+	}
+	closedir(d);
+	return best;
+}
+
+/* Returns the path of the newest non-empty scrollback log of this session, which
+   is under dir in year, month, and day directories, or null if there is none.
+   depth is the number of directory levels left to descend. */
+static char *newestlog(const char *dir, int depth)
+{
+	char *nm = 0, *sub, *fn = 0;
+	struct stat st;
+
+	while (!fn) {
+		sub = lastnumdir(dir, nm);
+		free(nm);
+		if (!(nm = sub)) return 0;
+
+		xasprintf(&sub, "%s/%s", dir, nm);
+		if (depth > 1)
+			fn = newestlog(sub, depth - 1);
+		else {
+			xasprintf(&fn, "%s/%s", sub, termid);
+			if (stat(fn, &st) || !st.st_size) { free(fn); fn = 0; }
+		}
+		free(sub);
+	}
+
+	free(nm);
+	return fn;
+}
+
+/* Copies about the last max bytes of in to out, starting at a line. */
+static void copytail(FILE *in, long max, FILE *out)
+{
+	int c;
+
+	if (fseek(in, -max, SEEK_END))	rewind(in);
+	else				while (EOF != (c = fgetc(in)) && c != '\n') {}
+
+	while (EOF != (c = fgetc(in))) fputc(c, out);
+}
+
+/* Shows the end of the scrollback of a lost session with the same ID, so its
+   history is not gone from view. */
+static void restorelost(FILE *out)
+{
+	char *fn = newestlog(state_dir(), 3);
+	FILE *lg;
+
+	if (fn && (lg = fopen(fn, "r"))) {
+		copytail(lg, 8192, out);
+		fclose(lg);
+	}
+	free(fn);
+
+	fputs("\n\033[7m the previous process of this session was lost "
+	      "\033[0m\n", out);
+}
+
 void _Noreturn subproc_main(Dtachctx dc)
 {
+	FILE *motdf;
+
 	const char *shell;
 
 	if (dc->spargs) { set_argv0(dc, 's'); spawner(dc->spargs); }
@@ -216,6 +824,18 @@ void _Noreturn subproc_main(Dtachctx dc)
 
 	setenv("TERM", "xterm-256color", 1);
 
+	if (dc->lostprev && !dc->isephem) restorelost(stdout);
+
+	/* The banner goes to the terminal before the shell starts, so it is
+	   the first output clients see. */
+	if (motd && !(motdf = fopen(motd, "r")))
+		warn("open motd file: %s", motd);
+	else if (motd) {
+		printmotd(motdf, stdout, dc);
+		fclose(motdf);
+	}
+	fflush(stdout);
+
 	execl(shell, shell, NULL);
 	err(1, "execl $SHELL, which is: %s", shell ? shell : "<undef>");
 }
@@ -270,7 +890,48 @@ static int opnforlog(const struct tm *tim, const char *suff)
 	return fd;
 }
 
-void open_logs(void)
+/* Starts recording the session to an asciicast v2 file in castdir, named after
+   the session ID. A number is added to the name if the file exists already. */
+static void opencast(time_t now)
+{
+	char *nm = 0, *fn = 0;
+	int i, fd = -1;
+	struct fdbuf b = {0};
+
+	if (termid)	nm = strdup(termid);
+	else		xasprintf(&nm, "eph%lld", (long long) getpid());
+
+	for (i = 0; fd < 0 && i < 100; i++) {
+		free(fn);
+		if (i)	xasprintf(&fn, "%s/%s.%d.cast", castdir, nm, i);
+		else	xasprintf(&fn, "%s/%s.cast", castdir, nm);
+
+		fd = open(fn, O_WRONLY | O_CREAT | O_EXCL | O_APPEND | O_CLOEXEC,
+			  0600);
+		if (fd < 0 && errno != EEXIST) break;
+	}
+	if (fd < 0) warn("open recording %s", fn);
+	free(fn);
+	if (fd < 0) goto cleanup;
+
+	wts.castde.fd = fd;
+	wts.writecast = 1;
+	clock_gettime(CLOCK_MONOTONIC, &wts.castt0);
+
+	b.de = &wts.castde;
+	fdb_apnd(&b, "{\"version\": 2, \"width\": 80, \"height\": 25, "
+		 "\"timestamp\": ", -1);
+	fdb_itoa(&b, now);
+	fdb_apnd(&b, ", \"title\": ", -1);
+	fdb_json(&b, nm, -1);
+	fdb_apnd(&b, ", \"env\": {\"TERM\": \"xterm-256color\"}}\n", -1);
+	fdb_finsh(&b);
+
+cleanup:
+	free(nm);
+}
+
+void open_logs(int isephem)
 {
 	time_t now;
 	struct tm tim;
@@ -278,6 +939,9 @@ void open_logs(void)
 	now = time(NULL);
 	if (!localtime_r(&now, &tim)) err(1, "cannot get time");
 
+	if (castdir) opencast(now);
+	if (isephem) return;
+
 	/* sblvl configures scrollback logging. If the string has "p" then plain
 	 * logging is on, if "r" then raw logging is on. */
 	if (!sblvl) sblvl = strdup("p");
@@ -312,7 +976,15 @@ static Dtachctx prepfordtach(void)
 	sp.bf = 0;
 	fdb_finsh(&sp);
 
+	if (termid) xasprintf(&dc->runmark, "%s/run%%%s", socksdir(), termid);
+
 	dc->isephem = !termid;
+	dc->observe = !!observe;
+	dc->draincli = cliclose && *cliclose == 'd';
+	dc->exitwait = exitwait ? atoi(exitwait) : 0;
+	dc->detachtmo = detachtmo ? atoi(detachtmo) : 0;
+	dc->idletmo = idletmo ? atoi(idletmo) : 0;
+	dc->owner = getenv("REMOTE_USER");
 
 	if (!dtachlog) return dc;
 
@@ -645,6 +1317,12 @@ void send_pream(int fd)
 		}));
 	}
 
+	/* Typed after the preamble, so it runs with the profile's setup. */
+	if (init && *init) {
+		fdb_apnd(&ob, init, -1);
+		fdb_apnd(&ob, "\r", -1);
+	}
+
 	fdb_finsh(&ob);
 }
 
@@ -660,10 +1338,125 @@ static void linetitl(struct fdbuf *o)
 	tmfree(td);
 }
 
+/* Finds the tag with the given key, returning a pointer to the start of the
+   k=v entry in wts.tags. */
+static char *findtag(const char *k, size_t kl)
+{
+	char *e = wts.tags;
+
+	while (e && *e) {
+		if (!strncmp(e, k, kl) && e[kl] == '=') return e;
+		e = strchr(e, '&');
+		if (e) e++;
+	}
+
+	return 0;
+}
+
+/* kv is of the form k=v. An empty v removes the tag. */
+static void settag(const char *kv)
+{
+	const char *eq = strchr(kv, '=');
+	char *e, *end;
+	size_t tl = strlen(wts.tags);
+
+	if (!eq || eq == kv || strchr(kv, '&')) {
+		warnx("invalid tag: %s", kv);
+		return;
+	}
+
+	e = findtag(kv, eq - kv);
+	if (e) {
+		end = strchr(e, '&');
+		if (end)		memmove(e, end+1, strlen(end+1)+1);
+		else if (e != wts.tags)	e[-1] = 0;
+		else			*e = 0;
+		tl = strlen(wts.tags);
+	}
+
+	if (!eq[1]) return;
+
+	if (tl + !!tl + strlen(kv) >= sizeof(wts.tags)) {
+		warnx("no room for tag: %s", kv);
+		return;
+	}
+	if (tl) wts.tags[tl++] = '&';
+	strcpy(wts.tags + tl, kv);
+}
+
+/* flt is either k=v to match a tag exactly, or k to match any value. */
+static int hastag(const char *flt)
+{
+	const char *eq = strchr(flt, '=');
+	size_t kl = eq ? eq - flt : strlen(flt), vl;
+	char *e = findtag(flt, kl);
+
+	if (!e)		return 0;
+	if (!eq)	return 1;
+
+	e += kl + 1;
+	vl = strcspn(e, "&");
+	return vl == strlen(eq+1) && !strncmp(e, eq+1, vl);
+}
+
+static void tagsjson(struct fdbuf *b)
+{
+	const char *e = wts.tags, *eq;
+	size_t el;
+
+	fdb_apnc(b, '{');
+	while (*e) {
+		el = strcspn(e, "&");
+		eq = memchr(e, '=', el);
+
+		if (e != wts.tags) fdb_apnc(b, ',');
+		fdb_json(b, e, eq - e);
+		fdb_apnc(b, ':');
+		fdb_json(b, eq + 1, e + el - eq - 1);
+
+		e += el;
+		if (*e) e++;
+	}
+	fdb_apnc(b, '}');
+}
+
+/* Records the round-trip time to a client and logs it if it is too slow.
+   jitter is smoothed the same way as in RTP (RFC 3550), in sixteenths of a ms
+   to keep precision. */
+static void recordrtt(unsigned rtt)
+{
+	unsigned d = rtt > wts.rtt ? rtt - wts.rtt : wts.rtt - rtt;
+	unsigned thresh = latwarn ? atoi(latwarn) : 1000;
+
+	if (!wts.rttseen)	d = 0;
+	wts.jitter16 += d - ((wts.jitter16 + 8) >> 4);
+	wts.rtt = rtt;
+	wts.rttseen = 1;
+
+	if (thresh && rtt >= thresh)
+		warnx("high latency: rtt=%ums jitter=%ums",
+		      rtt, (wts.jitter16 + 8) >> 4);
+}
+
+/* Writes the session title as a JSON string: the one set by a client, else the
+   one set with an OSC sequence, else text from the terminal. */
+static void titlejson(struct fdbuf *b)
+{
+	if (wts.clnttl)		fdb_json(b, wts.ttl, ttl_len());
+	else if (*wts.osctitl)	fdb_json(b, wts.osctitl, -1);
+	else			linetitl(b);
+}
+
 /* Array with elements:
 	0: print_atch_clis() array
 	1: termid string
-	2: title string */
+	2: title string
+	3: tags object
+	4: activity object: lastout is the time of the last output in seconds
+	   since the epoch, or 0 if there was none, and bell is whether the bell
+	   rang since a client last attached. rtt and jitter are the last
+	   round-trip time and its smoothed variation in ms, as measured with a
+	   client's latency probe. They are omitted until one is measured. */
 static void atchstatejson(Dtachctx dc, struct wrides *cliutd)
 {
 	struct fdbuf hbuf = {cliutd};
@@ -674,13 +1467,65 @@ static void atchstatejson(Dtachctx dc, struct wrides *cliutd)
 	fdb_apnc(&hbuf, ',');
 	fdb_json(&hbuf, termid ? termid : "", -1);
 	fdb_apnc(&hbuf, ',');
-	if (wts.clnttl)	fdb_json(&hbuf, wts.ttl, ttl_len());
-	else		linetitl(&hbuf);
+	titlejson(&hbuf);
+	fdb_apnc(&hbuf, ',');
+	tagsjson(&hbuf);
+	fdb_apnd(&hbuf, ",{\"lastout\":", -1);
+	fdb_itoa(&hbuf, dc->lastout);
+	fdb_apnd(&hbuf, wts.bell ? ",\"bell\":true" : ",\"bell\":false", -1);
+	if (wts.rttseen) {
+		fdb_apnd(&hbuf, ",\"rtt\":", -1);
+		fdb_itoa(&hbuf, wts.rtt);
+		fdb_apnd(&hbuf, ",\"jitter\":", -1);
+		fdb_itoa(&hbuf, (wts.jitter16 + 8) >> 4);
+	}
+	fdb_apnc(&hbuf, '}');
 
 	fdb_apnd(&hbuf, "]\n", -1);
 	fdb_finsh(&hbuf);
 }
 
+/* Describes the session as a JSON object, for /sessions. */
+static void sesnobjjson(Dtachctx dc, struct wrides *cliutd)
+{
+	struct fdbuf hbuf = {cliutd};
+	const char *shell = getenv("SHELL");
+
+	fdb_apnd(&hbuf, "{\"termid\":", -1);
+	fdb_json(&hbuf, termid ? termid : "", -1);
+	fdb_apnd(&hbuf, ",\"title\":", -1);
+	titlejson(&hbuf);
+	fdb_apnd(&hbuf, ",\"command\":", -1);
+	fdb_json(&hbuf, shell ? shell : "/bin/sh", -1);
+	fdb_apnd(&hbuf, ",\"started\":", -1);
+	fdb_itoa(&hbuf, dc->started);
+	fdb_apnd(&hbuf, ",\"lastout\":", -1);
+	fdb_itoa(&hbuf, dc->lastout);
+	fdb_apnd(&hbuf, ",\"attached\":", -1);
+	print_atch_clis(dc, &hbuf);
+	fdb_apnd(&hbuf, ",\"tags\":", -1);
+	tagsjson(&hbuf);
+	fdb_apnd(&hbuf, ",\"url\":\"/?termid=", -1);
+	fdb_apnd(&hbuf, termid ? termid : "", -1);
+	fdb_apnd(&hbuf, "\"}\n", -1);
+	fdb_finsh(&hbuf);
+}
+
+/* Replies to a \u query, which lets usercap= be enforced, with when the last
+   client detached if user started the session, - if a client is attached, or
+   an empty line if user did not start it. */
+static void ownerstate(Dtachctx dc, struct wrides *cliutd, const char *user)
+{
+	struct fdbuf b = {cliutd};
+
+	if (!dc->isephem && dc->owner && !strcmp(dc->owner, user)) {
+		if (has_atch_clis(dc))	fdb_apnc(&b, '-');
+		else			fdb_itoa(&b, dc->lastatch);
+	}
+	fdb_apnc(&b, '\n');
+	fdb_finsh(&b);
+}
+
 static void fwdlinetobuf(int fd, struct fdbuf *ob)
 {
 	int rdn;
@@ -700,12 +1545,35 @@ static void fwdlinetobuf(int fd, struct fdbuf *ob)
 	}
 }
 
-static void atchsesnlis(struct wrides *de)
+/* Returns the decoded value of an arg in the query string, such as "tag=", or
+   null if there is none. The value is only valid until the next call. */
+static const char *qryarg(Httpreq *rq, const char *nm)
+{
+	static char *val;
+
+	free(val);
+	val = 0;
+
+	for (qs = rq->query; *qs; qs++) {
+		if (parsequeryarg(nm, &val)) break;
+		qs = strchr(qs, '&');
+		if (!qs) break;
+	}
+
+	return val;
+}
+
+/* Lists the state of each session. If tagflt is given, only sessions with a
+   matching tag are listed. See hastag for the filter format. If asobj, each
+   session is described with an object, as in sesnobjjson, rather than an
+   array. */
+static void atchsesnlis(struct wrides *de, const char *tagflt, int asobj)
 {
 	DIR *skd;
 	struct dirent *sken;
 	char *spth = 0;
 	int sc, firs = 1;
+	size_t prelen;
 	struct fdbuf rb = {0};
 
 	if (!(skd = opendir(socksdir()))) {
@@ -732,12 +1600,22 @@ static void atchsesnlis(struct wrides *de)
 		free(spth);
 		if (sc < 0) continue;
 
+		prelen = rb.len;
 		if (!firs) fdb_apnc(&rb, ',');
-		firs = 0;
 
-		full_write(&(struct wrides){sc}, "\\A", -1);
+		if (tagflt) {
+			full_write(&(struct wrides){sc}, "\\a", -1);
+			full_write(&(struct wrides){sc}, tagflt, -1);
+			full_write(&(struct wrides){sc}, "\n", -1);
+		}
+		else
+			full_write(&(struct wrides){sc}, asobj ? "\\J" : "\\A", -1);
 		fwdlinetobuf(sc, &rb);
 		close(sc);
+
+		/* An empty line means the session did not match. */
+		if (rb.len <= prelen + !firs + 1)	rb.len = prelen;
+		else					firs = 0;
 	}
 
 	fdb_apnc(&rb, ']');
@@ -747,6 +1625,28 @@ static void atchsesnlis(struct wrides *de)
 	closedir(skd);
 }
 
+/* Returns whether flt can be given as a tag= filter. The filter is sent to each
+   session after an escape which ends at a newline, and the bytes after that
+   are typed into the session, so a filter which could end the escape or start
+   another one is refused. */
+static int tagfltok(const char *flt)
+{
+	for (; flt && *flt; flt++) {
+		if (*flt == '\\' || *flt == '&' || (unsigned char) *flt < ' '
+		    || *flt == 0x7f)
+			return 0;
+	}
+	return 1;
+}
+
+static void atchses(struct wrides *de, Httpreq *rq)
+{
+	const char *flt = qryarg(rq, "tag=");
+
+	if (tagfltok(flt))	atchsesnlis(de, flt, 0);
+	else			resp_dynamc(de, 't', 400, 0, 0);
+}
+
 static void writetosubproccore(
 	/* Where to send output for the process; this is raw keyboard input. */
 	struct wrides *procde,
@@ -763,9 +1663,12 @@ static void writetosubproccore(
 {
 	unsigned wi;
 	unsigned char byte, cursmvbyte;
-	struct fdbuf kbdb = {procde};
+	struct fdbuf kbdb = {cls->readonly ? 0 : procde}, clib = {clioutde};
+	struct termios tio;
 
 	wts.sendsigwin = 0;
+	wts.sendsig = 0;
+	wts.hangup = 0;
 
 	wi = 0;
 	while (bufsz--) {
@@ -797,6 +1700,10 @@ static void writetosubproccore(
 			case 'w':
 			case 't':
 			case 'i':
+			case 'g':
+			case 'a':
+			case 'u':
+			case 'p':
 				wts.altbufsz = 0;
 				wts.escp = byte;
 				break;
@@ -812,13 +1719,58 @@ static void writetosubproccore(
 			   the output. */
 			case 'N':
 				cls->wantsoutput=1;
+				wts.bell = 0;
 				if (wts.ttl[0])		recounttitl(clioutde);
 				if (wts.allowtmstate)	tmstate4cli(clioutde);
 				else			simpdump4cl(clioutde);
 				profinfo4cli(clioutde);
 				break;
 
-			case 'A':	atchstatejson(dc, clioutde); break;
+			case 'A':	atchstatejson(dc, clioutde); break;
+			case 'J':	sesnobjjson(dc, clioutde); break;
+
+			/* The client only observes the session, so the rest of
+			   its input is discarded. This cannot be undone. */
+			case 'O':
+				cls->readonly = 1;
+				fdb_finsh(&kbdb);
+				kbdb.de = 0;
+				break;
+
+			/* Signals for the foreground process, which work even
+			   if the terminal is in raw mode. */
+			case 'C':	wts.sendsig = SIGINT;	break;
+			case 'Z':	wts.sendsig = SIGTSTP;	break;
+
+			/* End the session, as if the terminal hung up. */
+			case 'X':	wts.hangup = 1;		break;
+
+			/* end-of-file, using whatever the subprocess has set
+			   as the EOF character, or ^D by default. */
+			case 'D':
+				fdb_apnc(&kbdb,
+					 tcgetattr(procde->fd, &tio)
+					 ? 004 : tio.c_cc[VEOF]);
+				break;
+
+			/* The client got the reply to its latency probe. */
+			case 'q':
+				if (cls->pongat)
+					recordrtt(msnow() - cls->pongat);
+				cls->pongat = 0;
+				break;
+
+			/* pause and resume output to this client */
+			case 'P':	cls->pausd = !cls->readonly; break;
+			case 'R':	cls->pausd = 0; break;
+
+			/* Client wants to know when echo is off, so it can
+			   echo locally only when the subprocess would. */
+			case 'H':
+				wts.echohint = 1;
+				wts.echoff = !ptyecho(procde->fd);
+				echohint(&clib);
+				break;
 
 			/* directions, home, end */
 			case '^':	cursmvbyte = 'A'; break;
@@ -855,6 +1807,10 @@ static void writetosubproccore(
 			break;
 
 		case 't':
+			if (cls->readonly) {
+				if (byte == '\n') wts.escp = 0;
+				break;
+			}
 			if (byte == '\n') {
 				wts.escp = 0;
 				byte = 0;
@@ -865,6 +1821,40 @@ static void writetosubproccore(
 
 			break;
 
+		case 'g':
+		case 'a':
+		case 'u':
+			if (byte != '\n') {
+				if (wts.altbufsz < sizeof(wts.tagarg) - 1)
+					wts.tagarg[wts.altbufsz++] = byte;
+				break;
+			}
+
+			wts.tagarg[wts.altbufsz] = 0;
+			if (wts.escp == 'g') {
+				if (!cls->readonly) settag(wts.tagarg);
+			}
+			else if (wts.escp == 'u')
+				ownerstate(dc, clioutde, wts.tagarg);
+			else if (hastag(wts.tagarg))	atchstatejson(dc, clioutde);
+			else				full_write(clioutde, "\n", 1);
+			wts.escp = 0;
+
+			break;
+
+		/* Latency probe: reply right away, and time how long the client
+		   takes to acknowledge the reply with \q. Older clients send the
+		   round-trip time they measured as an argument, which is not
+		   trusted. */
+		case 'p':
+			if (byte != '\n') break;
+
+			wts.escp = 0;
+			fdb_apnd(&clib, "\\@pong:\n", -1);
+			cls->pongat = msnow();
+
+			break;
+
 		case 'i':
 			if (wts.altbufsz >= sizeof cls->endpnt) abort();
 
@@ -878,21 +1868,39 @@ static void writetosubproccore(
 	}
 
 	fdb_finsh(&kbdb);
+	fdb_finsh(&clib);
 
+	if (cls->readonly) wts.sendsig = wts.sendsigwin = wts.hangup = 0;
 	if (wts.t && wts.sendsigwin) tresize(wts.t, wts.swcol, wts.swrow);
 }
 
-void process_kbd(int clioutfd, Dtachctx dc, struct clistate *cls,
+void process_kbd(struct fdbuf *cliout, Dtachctx dc, struct clistate *cls,
 		 unsigned char *buf, size_t bufsz)
 {
-	struct wrides ptyde = { dc->the_pty.fd }, clide = { clioutfd };
+	struct wrides ptyde = { dc->the_pty.fd }, clide = { .into = cliout };
 
 	struct winsize ws = {0};
+	pid_t fgpg;
+	char wsz[16];
 
 	writetosubproccore(&ptyde, &clide, dc, cls, buf, bufsz);
 
+	if (wts.sendsig) {
+		fgpg = tcgetpgrp(dc->the_pty.fd);
+		if (0 > fgpg || 0 > kill(-fgpg, wts.sendsig))
+			warn("sending signal %d", wts.sendsig);
+	}
+
+	if (wts.hangup && 0 > kill(-dc->the_pty.pid, SIGHUP))
+		warn("hanging up session");
+
 	if (!wts.sendsigwin) return;
 
+	if (wts.writecast) {
+		snprintf(wsz, sizeof(wsz), "%ux%u", wts.swcol, wts.swrow);
+		castevent(castsecs(), 'r', wsz, strlen(wsz));
+	}
+
 	ws.ws_row = wts.swrow;
 	ws.ws_col = wts.swcol;
 	if (0 > ioctl(dc->the_pty.fd, TIOCSWINSZ, &ws))
@@ -940,6 +1948,9 @@ static struct clistate *testclistate(char op)
 	case 'o':
 		printf("wantsoutput=%u\n", s->wantsoutput);
 	break;
+	case 'p':
+		printf("pausd=%u\n", s->pausd);
+	break;
 
 	default: abort();
 	}
@@ -957,6 +1968,9 @@ static void testreset(void)
 	free(termid);	termid = 0;
 	free(logview);	logview = 0;
 	free(sblvl);	sblvl = 0;
+	free(cliclose);	cliclose = 0;
+	free(motd);	motd = 0;
+	free(init);	init = 0;
 
 	profpathsavd = "";
 	testclistate('r');
@@ -972,12 +1986,57 @@ static void writetosp0term(const void *s)
 
 	if (wts.sendsigwin)
 		printf("sigwin r=%d c=%d\n", wts.swrow, wts.swcol);
+	if (wts.sendsig)
+		printf("signal %d\n", wts.sendsig);
 }
 
 static void tstdesc(const char *d) { printf("TEST: %s\n", d); }
 
+static void testechohint(void)
+{
+	int ptym, ptys;
+	struct termios tio;
+
+	testreset();
+	if (0 > openpty(&ptym, &ptys, 0, 0, 0)) err(1, "openpty");
+
+	snoop_echo(ptym);
+	putrwout();
+	printf("(no hints until client asks)\n");
+
+	writetosp0term("\\H");
+
+	if (0 > tcgetattr(ptys, &tio)) err(1, "tcgetattr");
+	tio.c_lflag &= ~ECHO;
+	if (0 > tcsetattr(ptys, TCSANOW, &tio)) err(1, "tcsetattr");
+	snoop_echo(ptym);
+	snoop_echo(ptym);
+	putrwout();
+
+	tio.c_lflag |= ECHO;
+	if (0 > tcsetattr(ptys, TCSANOW, &tio)) err(1, "tcsetattr");
+	snoop_echo(ptym);
+	putrwout();
+
+	close(ptym);
+	close(ptys);
+}
+
 static void testqrystring(void)
 {
+	FILE *memopen;
+	char tmpl[] =	"Welcome {user}, session={session} "
+			"limits: detach {detachtmo} idle {idletmo}\n"
+			"{unknown} {open {toolongnameforabracedvar} {\n";
+	char flags[] =	"# comment\n"
+			"sblvl=rp\n"
+			"\n"
+			"  idletmo=3600\r\n"
+			"allowip=10.0.0.0/8,::1&motd=/etc/motd%20x\n";
+	char flagsfn[64], *buf;
+	FILE *flagsf, *f;
+	struct stat st;
+
 	tstdesc("parse termid arg");
 	testreset();
 	processquerystr("termid=hello");
@@ -992,6 +2051,227 @@ static void testqrystring(void)
 	testreset();
 	processquerystr("sblvl=&termid=%21escapes%7eand%45");
 	printf("%zu,%s,%d\n", strlen(sblvl), termid, !logview);
+
+	tstdesc("cliclose arg");
+	testreset();
+	processquerystr("cliclose=drain&termid=x");
+	printf("%s,%s\n", cliclose, termid);
+
+	tstdesc("server settings in a client query string are ignored");
+	testreset();
+	maxhdrs = strdup("50");
+	processcliqs("termid=x&maxhdrs=9999&onconnect=/bin/evil&cliclose=drain");
+	printf("%s,%s,%s,%d\n", maxhdrs, termid, cliclose, !onconnect);
+	free(maxhdrs);
+	maxhdrs = 0;
+
+	tstdesc("token is hidden from hooks and authcmd");
+	setqsenv("termid=x&token=s3cret&tokens=1");
+	puts(getenv("QUERY_STRING"));
+	setqsenv("");
+	printf("[%s]\n", getenv("QUERY_STRING"));
+
+	tstdesc("init arg is typed after the preamble");
+	testreset();
+	processquerystr("logview=x.y&init=less%20%2BF%20%2Fvar%2Flog%2Ffoo");
+	f = tmpfile();
+	send_pream(fileno(f));
+	if (fstat(fileno(f), &st)) err(1, "fstat");
+	buf = malloc(st.st_size);
+	rewind(f);
+	if (st.st_size != fread(buf, 1, st.st_size, f)) errx(1, "fread");
+	fflush(stdout);
+	full_write(&(struct wrides){1, "pream"}, buf, st.st_size);
+	free(buf);
+	fclose(f);
+
+	tstdesc("motd template");
+	testreset();
+	processquerystr("termid=motdtest&motd=/etc/motd");
+	printf("%s\n", motd);
+	setenv("USER", "jdoe", 1);
+	unsetenv("REMOTE_USER");
+	memopen = fmemopen(tmpl, strlen(tmpl), "r");
+	printmotd(memopen, stdout, &(struct dtach_ctx){.idletmo = 90});
+	fclose(memopen);
+
+	tstdesc("motd user is the one who logged in");
+	setenv("REMOTE_USER", "webuser", 1);
+	memopen = fmemopen(tmpl, strlen(tmpl), "r");
+	printmotd(memopen, stdout, &(struct dtach_ctx){0});
+	fclose(memopen);
+	unsetenv("REMOTE_USER");
+
+	tstdesc("flags file");
+	testreset();
+	memopen = fmemopen(flags, strlen(flags), "r");
+	processflagsfile(memopen);
+	fclose(memopen);
+	printf("%s,%s,%s,%s\n", sblvl, idletmo, allowip, motd);
+	processquerystr("idletmo=60");
+	printf("%s\n", idletmo);
+
+	tstdesc("reload flags");
+	testreset();
+	flagsf = tmpfile();
+	fputs("idletmo=99\ndenyip=192.0.2.0/24\n", flagsf);
+	fflush(flagsf);
+	snprintf(flagsfn, sizeof(flagsfn), "/proc/self/fd/%d", fileno(flagsf));
+	setenv("WERMFLAGSFILE", flagsfn, 1);
+	setenv("WERMFLAGS", "denyip=198.51.100.0/24", 1);
+	processquerystr("allowip=10.0.0.0/8&idletmo=5&termid=keep");
+	reload_flags();
+	printf("%s,%s,%s,%s\n", idletmo, denyip, allowip ? allowip : "-",
+	       termid);
+
+	tstdesc("reload with an invalid CIDR list keeps old settings");
+	rewind(flagsf);
+	ftruncate(fileno(flagsf), 0);
+	fputs("idletmo=7\n", flagsf);
+	fflush(flagsf);
+	setenv("WERMFLAGS", "denyip=198.51.100.0/33", 1);
+	reload_flags();
+	printf("%s,%s\n", idletmo, denyip);
+
+	unsetenv("WERMFLAGSFILE");
+	unsetenv("WERMFLAGS");
+	fclose(flagsf);
+}
+
+static void testaccesslog(void)
+{
+	struct fdbuf b = {0};
+	Httpreq rq = {.addr = "192.0.2.8", .resource = "/",
+		      .query = "termid=x&token=s3cret&q=\"a\"%20b"};
+	char dir[] = "/tmp/wermaccess.XXXXXX", *fn = 0, *rot = 0, ln[128];
+	int i, fd;
+	pid_t pid;
+	FILE *f;
+
+	tstdesc("access log line");
+	setenv("TZ", "UTC", 1);
+	tzset();
+	fmtaccess(&b, &rq, 101, 1790000000, 0);
+	strcpy(rq.user, "jdoe");
+	strcpy(rq.resource, "/a\001b");
+	*rq.query = 0;
+	rq.head = 1;
+	fmtaccess(&b, &rq, 0, 1790000000, 0);
+	rq.head = 0;
+	fmtaccess(&b, &rq, 101, 1790000090, &(struct conninfo){
+		.start = 1790000000, .bytesin = 12, .bytesout = 3456,
+		.msgsin = 2, .msgsout = 30,
+	});
+	rq.head = 1;
+	fwrite(b.bf, b.len, 1, stdout);
+	fdb_finsh(&b);
+
+	tstdesc("access log rotation");
+	testreset();
+	if (!mkdtemp(dir)) err(1, "mkdtemp");
+	xasprintf(&fn, "%s/access", dir);
+	accesslog = strdup(fn);
+	accesslogmax = strdup("1");
+	accesslogkeep = strdup("2");
+	for (i = 0; i < 4; i++) {
+		snprintf(rq.resource, sizeof(rq.resource), "/%d", i);
+		logaccess(&rq, 0);
+	}
+	for (i = 0; i < 4; i++) {
+		free(fn);
+		fn = 0;
+		if (i)	xasprintf(&fn, "%s/access.%d", dir, i);
+		else	xasprintf(&fn, "%s/access", dir);
+		printf("%d: ", i);
+		if (!(f = fopen(fn, "r"))) { puts("none"); continue; }
+		while (fgets(ln, sizeof(ln), f)) fputs(strchr(ln, '"'), stdout);
+		fclose(f);
+		unlink(fn);
+	}
+
+	tstdesc("access log rotated while waiting for lock");
+	free(accesslogmax);
+	accesslogmax = 0;
+	free(fn);
+	fn = 0;
+	xasprintf(&fn, "%s/access", dir);
+	if (0 > (fd = open(fn, O_WRONLY | O_CREAT, 0600))) err(1, "open");
+	if (0 > flock(fd, LOCK_EX)) err(1, "flock");
+	fflush(stdout);
+	if (!(pid = fork())) {
+		close(fd);
+		strcpy(rq.resource, "/waited");
+		logaccess(&rq, 0);
+		_exit(0);
+	}
+	usleep(100000);
+	xasprintf(&rot, "%s.1", fn);
+	if (rename(fn, rot)) err(1, "rename");
+	close(fd);
+	waitpid(pid, 0, 0);
+	for (i = 0; i < 2; i++) {
+		printf("%d: ", i);
+		if (!(f = fopen(i ? rot : fn, "r"))) { puts("none"); continue; }
+		while (fgets(ln, sizeof(ln), f)) fputs(strchr(ln, '"'), stdout);
+		if (!ftell(f)) puts("empty");
+		fclose(f);
+	}
+	unlink(fn);
+	unlink(rot);
+	free(rot);
+	free(fn);
+	rmdir(dir);
+
+	free(accesslog);	accesslog = 0;
+	free(accesslogmax);	accesslogmax = 0;
+	free(accesslogkeep);	accesslogkeep = 0;
+}
+
+static void testwrtmo(void)
+{
+	static char buf[60000];
+	int sv[2], st, sz = 4096;
+	pid_t pid;
+
+	tstdesc("write to a stalled websocket client times out");
+	wrtmo = strdup("1");
+	if (socketpair(AF_UNIX, SOCK_STREAM, 0, sv)) err(1, "socketpair");
+	if (setsockopt(sv[0], SOL_SOCKET, SO_SNDBUF, &sz, sizeof(sz)))
+		err(1, "SO_SNDBUF");
+	fflush(stdout);
+	if (!(pid = fork())) {
+		close(sv[1]);
+		dup2(sv[0], 1);
+		for (;;) write_wbsoc_frame(buf, sizeof(buf));
+	}
+	close(sv[0]);
+	waitpid(pid, &st, 0);
+	printf("exited: %d, status: %d\n", WIFEXITED(st), WEXITSTATUS(st));
+	close(sv[1]);
+	free(wrtmo);
+	wrtmo = 0;
+}
+
+static void testcast(void)
+{
+	FILE *f = tmpfile();
+	int c;
+
+	tstdesc("asciicast events");
+	testreset();
+	wts.castde.fd = fileno(f);
+	castevent(0.5, 'o', "a\"\033[1m\342\202", 8);
+	castevent(1.25, 'o', "\254!\r\n", 4);
+	castevent(2, 'o', "\360", 1);
+	castevent(3, 'r', "120x40", 6);
+	printf("held: %u\n", wts.castholdn);
+
+	rewind(f);
+	while (EOF != (c = fgetc(f))) {
+		if (c < 0x80)	putchar(c);
+		else		printf("\\%03o", c);
+	}
+	fclose(f);
 }
 
 static void testiterprofs(void)
@@ -1188,6 +2468,9 @@ static void writelgon(void)
 static void _Noreturn testmain(void)
 {
 	int i;
+	FILE *memopen;
+	char lgtxt[] = "line1\nline2\nline3\n";
+	Httpreq tagrq = {.query = "tag=x%0Arm%20-rf%20~%0A"};
 
 	tstdesc("WRITE_TO_SUBPROC_CORE");
 
@@ -1219,6 +2502,33 @@ static void _Noreturn testmain(void)
 	testreset();
 	writetosp0term("about to resize...\\w00910042...all done");
 
+	tstdesc("signal escapes:");
+	testreset();
+	writetosp0term("sleep 100\r\\C");
+	writetosp0term("vim\r\\Z");
+
+	tstdesc("EOF escape when EOF char is unknown:");
+	testreset();
+	writetosp0term("cat\r\\D");
+
+	tstdesc("pause and resume output:");
+	testreset();
+	testclistate('p');
+	writetosp0term("\\P");
+	testclistate('p');
+	writetosp0term("abc\\R");
+	testclistate('p');
+
+	tstdesc("observer input is ignored:");
+	testreset();
+	writetosp0term("ab\\Ocd\\n\\C\\X\\w00240100\\tnew title\n\\gk=v\n\\N\\P");
+	testclistate('o');
+	testclistate('p');
+	printf("ttl=%u tags=%s hangup=%u\n", ttl_len(), wts.tags, wts.hangup);
+
+	tstdesc("echo hints:");
+	testechohint();
+
 	tstdesc("escape seqs:");
 	testreset();
 	writetosp0term("line one\\nline two\\nline 3 \\\\ (reverse solidus)\\n\n");
@@ -1603,6 +2913,101 @@ static void _Noreturn testmain(void)
 	writetosp0term("\\A");
 	process_tty_out("again, ttl from line\r\n", -1);
 	writetosp0term("\\A");
+	tstdesc("... title from OSC sequence");
+	process_tty_out("\033]2;vim foo.c\007", -1);
+	writetosp0term("\\A");
+	tstdesc("... client-set title has precedence");
+	writetosp0term("\\tclient ttl\n");
+	writetosp0term("\\A");
+	writetosp0term("\\t\n");
+	writetosp0term("\\A");
+	tstdesc("... OSC 0 also sets title");
+	process_tty_out("\033]0;top\033\\", -1);
+	writetosp0term("\\A");
+
+	tstdesc("session object in \\J output");
+	setenv("SHELL", "/bin/testsh", 1);
+	writetosp0term("\\J");
+
+	tstdesc("session tags in \\A output");
+	testreset();
+	termid = strdup("tagtest");
+	process_tty_out("$ make\r\n", -1);
+	writetosp0term("\\gproject=werm\n\\ghost=x\"y\n\\A");
+	tstdesc("... replace and remove tags");
+	writetosp0term("\\gproject=other\n\\A");
+	writetosp0term("\\ghost=\n\\A");
+	writetosp0term("\\gproject=\n\\A");
+	tstdesc("... invalid tags");
+	writetosp0term("\\gnoequals\n\\g=novalue\n\\ga=b&c=d\n\\A");
+
+	tstdesc("filter session state by tag");
+	testreset();
+	process_tty_out("$ make\r\n", -1);
+	writetosp0term("\\gproject=werm\n\\gpurpose=build\n");
+	writetosp0term("\\aproject=werm\n");
+	writetosp0term("\\aproject=wer\n");
+	writetosp0term("\\apurpose\n");
+	writetosp0term("\\ahost\n");
+
+	tstdesc("tag filter which could end the escape is refused");
+	printf("%d %d\n", tagfltok(qryarg(&tagrq, "tag=")), tagfltok("a=b c"));
+
+	tstdesc("which user started the session, for usercap=");
+	testreset();
+	testdc('g')->owner = "alice";
+	testdc('g')->lastatch = 1790000000;
+	writetosp0term("\\ualice\n");
+	writetosp0term("\\ubob\n");
+	testdc('g')->isephem = 1;
+	writetosp0term("\\ualice\n");
+
+	tstdesc("bell in \\A output until client attaches");
+	testreset();
+	process_tty_out("$ make\a\r\n", -1);
+	writetosp0term("\\A");
+	writetosp0term("\\N");
+	writetosp0term("\\A");
+
+	tstdesc("OSC 9 and 777 notifications set bell");
+	testreset();
+	process_tty_out("\033]9;build done; 0 errors\a", -1);
+	writetosp0term("\\A");
+	writetosp0term("\\N");
+	process_tty_out("\033]777;notify;make;done\033\\", -1);
+	writetosp0term("\\A");
+	writetosp0term("\\N");
+	process_tty_out("\033]777;other;make;done\a", -1);
+	writetosp0term("\\A");
+
+	tstdesc("latency probes");
+	testreset();
+	process_tty_out("$ ", -1);
+	writetosp0term("\\A");
+	writetosp0term("\\q\\p\n");
+	printf("rttseen=%u\n", wts.rttseen);
+	writetosp0term("\\q");
+	printf("rttseen=%u\n", wts.rttseen);
+	testreset();
+	process_tty_out("$ ", -1);
+	recordrtt(120);
+	recordrtt(100);
+	writetosp0term("\\A");
+	recordrtt(1500);
+	writetosp0term("\\A");
+
+	tstdesc("round-trip time given by an older client is ignored");
+	testreset();
+	process_tty_out("$ ", -1);
+	writetosp0term("\\p15");
+	writetosp0term("00\n\\A");
+
+	tstdesc("tail of lost session log");
+	testreset();
+	memopen = fmemopen(lgtxt, strlen(lgtxt), "r");
+	copytail(memopen, 8, stdout);
+	copytail(memopen, 100, stdout);
+	fclose(memopen);
 
 	tstdesc("tab backwards");
 	testreset();
@@ -1616,8 +3021,13 @@ static void _Noreturn testmain(void)
 
 	testiterprofs();
 	testqrystring();
+	testaccesslog();
+	testwrtmo();
+	testcast();
 	test_outstreams();
 	test_http();
+	test_auth();
+	test_metrics();
 
 	exit(0);
 }
@@ -1706,7 +3116,245 @@ static int maybeservefont(struct wrides *de, const char *resource)
 	return 1;
 }
 
-static _Noreturn void becomewebsocket(const char *quer)
+/* The request of the websocket connection this process serves. */
+static Httpreq wsrq;
+
+static void setenvnum(const char *nm, long long v)
+{
+	char buf[32];
+
+	snprintf(buf, sizeof(buf), "%lld", v);
+	setenv(nm, buf, 1);
+}
+
+/* Starts cmd with the details of the websocket connection in its environment,
+   without waiting for it. It is run in a grandchild so it is not left as a
+   zombie while the connection is open. */
+static void runhook(const char *cmd, const char *event)
+{
+	pid_t pid;
+
+	if (!cmd) return;
+
+	if (0 > (pid = fork())) { perror("fork hook"); return; }
+	if (pid) {
+		if (0 > waitpid(pid, 0, 0)) perror("waitpid hook");
+		return;
+	}
+
+	if (0 > (pid = fork())) perror("fork hook");
+	if (pid) _exit(0);
+
+	setenv("WERMEVENT", event, 1);
+	setenv("WERMTERMID", myconn->termid, 1);
+	setqsenv(wsrq.query);
+	setenvnum("WERMSTART", myconn->start);
+	setenvnum("WERMBYTESIN", myconn->bytesin);
+	setenvnum("WERMBYTESOUT", myconn->bytesout);
+	setenvnum("WERMMSGSIN", myconn->msgsin);
+	setenvnum("WERMMSGSOUT", myconn->msgsout);
+
+	/* Keep the command from reading or writing the connection. */
+	dup2(2, 1);
+	close(0);
+	open("/dev/null", O_RDONLY);
+
+	execl(cmd, cmd, NULL);
+	perror("execl hook");
+	_exit(127);
+}
+
+/* Logs the traffic of the websocket connection when it closes, and runs the
+   ondisconnect= hook. Other processes forked from this one, such as the dtach
+   master, inherit the handler but do nothing. */
+static void wsclosed(void)
+{
+	if (!myconn || myconn->pid != getpid()) return;
+
+	logaccess(&wsrq, myconn);
+	runhook(ondisconnect, "disconnect");
+}
+
+/* Waits up to secs seconds, while discarding any input from the client. Exits
+   if the client closes the connection. */
+static void playwait(double secs, int nullfd)
+{
+	struct timespec now, end;
+	struct timeval tmo;
+	fd_set fds;
+	double left;
+
+	clock_gettime(CLOCK_MONOTONIC, &end);
+	end.tv_sec += (time_t) secs;
+	end.tv_nsec += (long) ((secs - (time_t) secs) * 1e9);
+	if (end.tv_nsec >= 1000000000) {
+		end.tv_sec++;
+		end.tv_nsec -= 1000000000;
+	}
+
+	for (;;) {
+		clock_gettime(CLOCK_MONOTONIC, &now);
+		left = end.tv_sec - now.tv_sec
+			+ (end.tv_nsec - now.tv_nsec) / 1e9;
+		if (left <= 0) return;
+
+		tmo.tv_sec = left;
+		tmo.tv_usec = (left - tmo.tv_sec) * 1e6;
+		FD_ZERO(&fds);
+		FD_SET(0, &fds);
+		if (0 < select(1, &fds, 0, 0, &tmo)
+		    && fwrd_inbound_frames(nullfd))
+			exit(0);
+	}
+}
+
+/* Plays back the recording named play in castdir, sending its output to the
+   client with the original timing, sped up by the speed= factor. Resizes in the
+   recording are not played, since the client decides the window size. */
+static _Noreturn void playcast(void)
+{
+	FILE *f;
+	char *fn = 0, *ln = 0, *e;
+	const char *s;
+	size_t lnsz = 0;
+	double t, prev = 0, mul = speed ? atof(speed) : 1;
+	struct fdbuf kind = {0}, dat = {0}, out = {0};
+	int nullfd = open("/dev/null", O_WRONLY);
+
+	if (mul <= 0) mul = 1;
+	if (!castdir) exit_msg("e", "recordings are not enabled", -1);
+	if (!*play || strpbrk(play, ILLEGALTERMIDCHARS))
+		exit_msg("e", "invalid recording name", -1);
+
+	xasprintf(&fn, "%s/%s.cast", castdir, play);
+	f = fopen(fn, "r");
+	free(fn);
+	if (!f) exit_msg("e", "cannot open recording, errno: ", errno);
+
+	/* The first line is the header. */
+	getline(&ln, &lnsz, f);
+	while (0 < getline(&ln, &lnsz, f)) {
+		if (*ln != '[') continue;
+		t = strtod(ln + 1, &e);
+		s = e + strspn(e, ", ");
+		if (!(s = fdb_unjson(&kind, s))) goto next;
+		s += strspn(s, ", ");
+		if (!(s = fdb_unjson(&dat, s))) goto next;
+		if (kind.len != 1 || *kind.bf != 'o') goto next;
+
+		if (t > prev) playwait((t - prev) / mul, nullfd);
+		prev = t;
+
+		fdb_routs(&out, (char *) dat.bf, dat.len);
+		fdb_apnc(&out, '\n');
+		write_wbsoc_frame(out.bf, out.len);
+
+	next:
+		kind.len = dat.len = out.len = 0;
+	}
+
+	fclose(f);
+	exit_msg("", "end of recording", -1);
+}
+
+/* Ends the persistent session with the given termid by asking its master to
+   hang up the terminal. Returns 0 if there is no such session. */
+static int endsession(const char *tid)
+{
+	char *spth;
+	int sc;
+
+	xasprintf(&spth, "%s/prs%%%s", socksdir(), tid);
+	sc = connect_uds_as_client(spth);
+	free(spth);
+	if (sc < 0) return 0;
+
+	full_write(&(struct wrides){sc}, "\\X", -1);
+	close(sc);
+	return 1;
+}
+
+struct ownsesn {
+	long long detachd;
+	char *tid;
+};
+
+static int cmpdetachd(const void *a, const void *b)
+{
+	long long x = ((const struct ownsesn *) a)->detachd;
+	long long y = ((const struct ownsesn *) b)->detachd;
+
+	return (x > y) - (x < y);
+}
+
+/* Before the user who logged in starts a new persistent session, ends those of
+   their sessions which have been detached the longest, so they do not have more
+   than usercap= sessions. Sessions with a client attached are never ended, so
+   the cap may be passed while they are in use. */
+static void capusersesns(void)
+{
+	const char *user = getenv("REMOTE_USER");
+	int cap = usercap ? atoi(usercap) : 0, sc;
+	DIR *skd;
+	struct dirent *sken;
+	char *spth;
+	struct fdbuf rep = {0};
+	struct ownsesn *det = 0;
+	size_t ndet = 0, own = 0, i;
+
+	if (cap <= 0 || !user || !termid || observe) return;
+
+	if (!(skd = opendir(socksdir()))) {
+		perror("opendir: socks");
+		return;
+	}
+
+	while ((sken = readdir(skd))) {
+		if (strncmp(sken->d_name, "prs%", 4)) continue;
+
+		xasprintf(&spth, "%s/%s", socksdir(), sken->d_name);
+		sc = connect_uds_as_client(spth);
+		free(spth);
+		if (sc < 0) continue;
+
+		/* Attaching to a running session does not add one. */
+		if (!strcmp(sken->d_name + 4, termid)) {
+			close(sc);
+			own = 0;
+			break;
+		}
+
+		full_write(&(struct wrides){sc}, "\\u", -1);
+		full_write(&(struct wrides){sc}, user, -1);
+		full_write(&(struct wrides){sc}, "\n", -1);
+		rep.len = 0;
+		fwdlinetobuf(sc, &rep);
+		close(sc);
+		fdb_apnc(&rep, 0);
+
+		if (*rep.bf == '\n') continue;
+		own++;
+		if (*rep.bf == '-') continue;
+
+		det = realloc(det, sizeof(*det) * (ndet + 1));
+		det[ndet].detachd = atoll((char *) rep.bf);
+		det[ndet++].tid = strdup(sken->d_name + 4);
+	}
+
+	qsort(det, ndet, sizeof(*det), cmpdetachd);
+	for (i = 0; i < ndet && own - i >= (size_t) cap; i++) {
+		fprintf(stderr, "ending session %s of %s, over usercap=%d\n",
+			det[i].tid, user, cap);
+		endsession(det[i].tid);
+	}
+
+	while (ndet) free(det[--ndet].tid);
+	free(det);
+	fdb_finsh(&rep);
+	closedir(skd);
+}
+
+static _Noreturn void becomewebsocket(Httpreq *rq)
 {
 	/* These query args settings do not get inherited from the spawner to
 	   children. */
@@ -1714,12 +3362,38 @@ static _Noreturn void becomewebsocket(const char *quer)
 	dtachlog = 0;
 	free(termid);
 	termid = 0;
-
-	processquerystr(quer);
+	free(play);
+	play = 0;
+	free(speed);
+	speed = 0;
+	free(observe);
+	observe = 0;
+	free(init);
+	init = 0;
+
+	processcliqs(rq->query);
 	if (termid) {
 		checktid();
 		if (!strchr(termid, '.')) appendunqid();
 	}
+	if (observe && (!observers || strcmp(observers, "allow")))
+		exit_msg("e", "observing is not allowed", -1);
+	if (observe && !termid) exit_msg("e", "termid= is needed to observe", -1);
+	if (init && (!initinput || strcmp(initinput, "allow")))
+		exit_msg("e", "init= is not allowed", -1);
+
+	metrics_claimconn();
+	snprintf(myconn->addr, sizeof(myconn->addr), "%s", rq->addr);
+	snprintf(myconn->user, sizeof(myconn->user), "%s", rq->user);
+	snprintf(myconn->termid, sizeof(myconn->termid), "%s",
+		 termid ? termid : "");
+	myconn->observer = !!observe;
+	wsrq = *rq;
+	atexit(wsclosed);
+	runhook(onconnect, "connect");
+
+	if (play) playcast();
+	capusersesns();
 
 	dtach_main(prepfordtach());
 }
@@ -1782,11 +3456,134 @@ cleanup:
 	fdb_finsh(&b);
 }
 
+/* Serves a session transcript as plain text if fmt=text, otherwise HTML. */
+static void transcript(struct wrides *out, Httpreq *rq)
+{
+	const char *fmt = qryarg(rq, "fmt=");
+
+	externalcgi(out, fmt && !strcmp(fmt, "text") ? 't' : 'h', rq);
+}
+
+static void servemetrics(struct wrides *out)
+{
+	struct fdbuf b = {0};
+
+	if (!metrics) { resp_dynamc(out, 't', 503, 0, 0); return; }
+
+	metrics_write(&b, metrics);
+	resp_dynamc(out, 't', 200, b.bf, b.len);
+	fdb_finsh(&b);
+}
+
+/* Reports whether new sessions can be started: the sockets directory must be
+   writable and a process must be able to fork. */
+static void servereadyz(struct wrides *out)
+{
+	pid_t p;
+	int st;
+	char *why = 0;
+
+	if (access(socksdir(), W_OK))	why = "sockets dir not writable\n";
+	else if ((p = fork()) < 0)	why = "cannot fork\n";
+	else if (!p)			_exit(0);
+	else if (0 > waitpid(p, &st, 0)) perror("waitpid for readyz");
+
+	if (why)	resp_dynamc(out, 't', 503, why, strlen(why));
+	else		resp_dynamc(out, 't', 200, "ok\n", 3);
+}
+
+static void connjson(struct fdbuf *b, const struct conninfo *c)
+{
+	fdb_apnd(b, "{\"pid\":", -1);
+	fdb_itoa(b, c->pid);
+	fdb_apnd(b, ",\"addr\":", -1);
+	fdb_json(b, c->addr, -1);
+	fdb_apnd(b, ",\"user\":", -1);
+	fdb_json(b, c->user, -1);
+	fdb_apnd(b, ",\"termid\":", -1);
+	fdb_json(b, c->termid, -1);
+	fdb_apnd(b, c->observer ? ",\"observer\":true" : ",\"observer\":false",
+		 -1);
+	fdb_apnd(b, ",\"start\":", -1);
+	fdb_itoa(b, c->start);
+	fdb_apnd(b, ",\"bytesin\":", -1);
+	fdb_itoa(b, c->bytesin);
+	fdb_apnd(b, ",\"bytesout\":", -1);
+	fdb_itoa(b, c->bytesout);
+	fdb_apnd(b, ",\"msgsin\":", -1);
+	fdb_itoa(b, c->msgsin);
+	fdb_apnd(b, ",\"msgsout\":", -1);
+	fdb_itoa(b, c->msgsout);
+	fdb_apnc(b, '}');
+}
+
+/* Closes the websocket connection served by pid, which must be in the
+   connection table so no other process can be signaled. */
+static int endconn(pid_t pid)
+{
+	struct conninfo *c;
+
+	for (c = metrics->conn; c < metrics->conn + MAXCONNINFO; c++)
+		if (pid > 0 && c->pid == pid) return !kill(pid, SIGHUP);
+	return 0;
+}
+
+/* Lists the open websocket connections as JSON. A DELETE request instead ends
+   the session given by termid=, or closes the connection given by pid=. */
+static void serveadmin(struct wrides *out, Httpreq *rq)
+{
+	const char *user = getenv("REMOTE_USER"), *arg;
+	struct conninfo *c;
+	struct fdbuf b = {0};
+	int found;
+
+	if (adminusers && (!user || !inlist(adminusers, user))) {
+		resp_dynamc(out, 't', 403, 0, 0);
+		return;
+	}
+	if (!metrics) { resp_dynamc(out, 't', 503, 0, 0); return; }
+
+	if (rq->del) {
+		if ((arg = qryarg(rq, "termid=")))
+			found = !strpbrk(arg, ILLEGALTERMIDCHARS)
+				&& endsession(arg);
+		else if ((arg = qryarg(rq, "pid=")))
+			found = endconn(atoi(arg));
+		else {
+			resp_dynamc(out, 't', 400, 0, 0);
+			return;
+		}
+
+		if (found)	resp_dynamc(out, 't', 200, "ok\n", 3);
+		else		resp_dynamc(out, 't', 404, 0, 0);
+		return;
+	}
+
+	fdb_apnc(&b, '[');
+	for (c = metrics->conn; c < metrics->conn + MAXCONNINFO; c++) {
+		if (!c->pid) continue;
+		if (b.len > 1) fdb_apnc(&b, ',');
+		connjson(&b, c);
+	}
+	fdb_apnd(&b, "]\n", -1);
+
+	resp_dynamc(out, 'j', 200, b.bf, b.len);
+	fdb_finsh(&b);
+}
+
 static void httphandlers(struct wrides *out, Httpreq *rq)
 {
 	const char *rs = rq->resource;
 
+	if (!strcmp(rs, "/healthz"))	{ resp_dynamc(out, 't', 200, "ok\n", 3);
+									return;}
+	if (!strcmp(rs, "/readyz"))	{ servereadyz(out);		return;}
+
 	fprintf(stderr, "serving: %s\n", rs);
+	if (adminpath && !strcmp(rs, adminpath))
+					{ serveadmin(out, rq);		return;}
+	if (rq->del)			{ resp_dynamc(out, 't', 405, 0, 0);
+									return;}
 	if (maybeservefont(out, rs))	return;
 
 	if (!strcmp(rs, "/"))		{ resp_static(out, 'h', "/index.html");
@@ -1797,25 +3594,202 @@ static void httphandlers(struct wrides *out, Httpreq *rq)
 	if (!strcmp(rs, "/endptid.js"))	{ resp_static(out, 'j', rs);	return;}
 	if (!strcmp(rs, "/aux.js"))	{ externalcgi(out, 'j', rq);	return;}
 	if (!strcmp(rs, "/scrollback"))	{ externalcgi(out, 'h', rq);	return;}
+	if (!strcmp(rs, "/sbsearch"))	{ externalcgi(out, 'j', rq);	return;}
+	if (!strcmp(rs, "/histsearch"))	{ externalcgi(out, 'j', rq);	return;}
 	if (!strcmp(rs, "/st"))		{ externalcgi(out, 'j', rq);	return;}
 	if (!strcmp(rs, "/showenv"))	{ externalcgi(out, 't', rq);	return;}
-	if (!strcmp(rs, "/atchses"))	{ atchsesnlis(out);		return;}
+	if (!strcmp(rs, "/transcript"))	{ transcript(out, rq);		return;}
+	if (!strcmp(rs, "/atchses"))	{ atchses(out, rq);		return;}
+	if (!strcmp(rs, "/sessions"))	{ atchsesnlis(out, 0, 1);	return;}
 	if (!strcmp(rs, "/readme"))	{ servereadme(out);		return;}
 	if (!strcmp(rs, "/newsess"))	{ begnsesnlis(out);		return;}
+	if (metricspath && !strcmp(rs, metricspath))
+					{ servemetrics(out);		return;}
 
 	resp_dynamc(out, 't', 404, 0, 0);
 }
 
+/* Returns the token websocket clients must give, or null if none is needed.
+   The token file is read each time so the token can be changed without a
+   restart. If it cannot be read, no token is accepted. */
+static const char *wantedtoken(void)
+{
+	static char tok[256];
+	FILE *f;
+
+	if (authtoken)		return authtoken;
+	if (!authtokenfile)	return 0;
+
+	*tok = 0;
+	if (!(f = fopen(authtokenfile, "r"))) {
+		perror("open authtokenfile");
+		return tok;
+	}
+	if (!fgets(tok, sizeof(tok), f)) *tok = 0;
+	tok[strcspn(tok, "\r\n")] = 0;
+	fclose(f);
+
+	return tok;
+}
+
+/* Writes the address of the client connected on stdin to buf. */
+static void peeraddr(char *buf, size_t sz)
+{
+	struct sockaddr_storage sa;
+	socklen_t sl = sizeof(sa);
+	const void *ad = 0;
+
+	if (!getpeername(0, (struct sockaddr *) &sa, &sl)) {
+		if (sa.ss_family == AF_INET)
+			ad = &((struct sockaddr_in *) &sa)->sin_addr;
+		if (sa.ss_family == AF_INET6)
+			ad = &((struct sockaddr_in6 *) &sa)->sin6_addr;
+		if (sa.ss_family == AF_UNIX) {
+			snprintf(buf, sz, "local");
+			return;
+		}
+	}
+
+	if (!ad || !inet_ntop(sa.ss_family, ad, buf, sz))
+		snprintf(buf, sz, "unknown");
+}
+
+/* Runs authcmd to decide whether to accept a websocket upgrade. It gets the
+   request in CGI-style environment variables, and accepts it by exiting with
+   status 0. */
+static int runauthcmd(void *rqp)
+{
+	Httpreq *rq = rqp;
+	struct fdbuf *he = rq->hdrenv;
+	char *v;
+	int st, code = authcmdcode ? atoi(authcmdcode) : 403;
+	pid_t pid;
+
+	if (code != 401 && code != 404) code = 403;
+
+	/* The whole header has been read, so hdrtmo= no longer applies. Let the
+	   command take as long as it needs, e.g. to check with an LDAP server,
+	   rather than have SIGALRM end this process partway through. */
+	alarm(0);
+
+	if (0 > (pid = fork())) { perror("fork authcmd"); return 500; }
+	if (!pid) {
+		for (v = (char *) he->bf; v < (char *) he->bf + he->len;
+		     v += strlen(v) + 1)
+			putenv(v);
+		setenv("PATH_INFO", rq->resource, 1);
+		setqsenv(rq->query);
+		setenv("REMOTE_ADDR", rq->addr, 1);
+		if (*rq->user) setenv("REMOTE_USER", rq->user, 1);
+
+		/* Keep the command from reading or writing the connection. */
+		dup2(2, 1);
+		close(0);
+		open("/dev/null", O_RDONLY);
+
+		execl(authcmd, authcmd, NULL);
+		perror("execl authcmd");
+		_exit(127);
+	}
+
+	if (0 > waitpid(pid, &st, 0)) { perror("waitpid authcmd"); return 500; }
+	if (WIFEXITED(st) && !WEXITSTATUS(st)) return 0;
+
+	fprintf(stderr, "authcmd rejected %s from %s\n",
+		rq->resource, rq->addr);
+	return code;
+}
+
+static void onalarm(int sig) {}
+
+/* Waits up to secs seconds, or indefinitely if secs is 0, for the client to
+   start another request. Returns 0 if it does not, e.g. because it closed the
+   connection. */
+static int awaitreq(int secs)
+{
+	int c;
+
+	sigaction(SIGALRM, &(struct sigaction){.sa_handler = onalarm}, 0);
+	alarm(secs);
+	c = getc(stdin);
+	alarm(0);
+	signal(SIGALRM, SIG_DFL);
+
+	if (c == EOF) return 0;
+	ungetc(c, stdin);
+	return 1;
+}
+
 int http_serv(void)
 {
 	struct fdbuf b = {0};
 	struct wrides out = {1};
 	Httpreq rq = {0};
 	const char *rs = rq.resource;
+	struct fdbuf hdrenv = {0};
+	static int served;
+	int tmo = hdrtmo ? atoi(hdrtmo) : 60;
+
+	if (maxhdrs)		rq.maxhdrs	= atoi(maxhdrs);
+	if (maxhdrbytes)	rq.maxhdrbytes	= atoi(maxhdrbytes);
+	rq.denynullorig	= nullorigin && !strcmp(nullorigin, "deny");
+	rq.denynoorig	= noorigin && !strcmp(noorigin, "deny");
+	rq.htpasswd	= htpasswd;
+	rq.authtoken	= wantedtoken();
+	rq.allowip	= allowip;
+	rq.denyip	= denyip;
+	rq.trustproxy	= trustproxy;
+	rq.deflate	= deflvl ? atoi(deflvl) : 0;
+	rq.deflatereset	= deflctx && !strcmp(deflctx, "reset");
+	rq.protocols	= protocols;
+	peeraddr(rq.addr, sizeof(rq.addr));
+	if (authcmd) {
+		rq.hdrenv	= &hdrenv;
+		rq.allowws	= runauthcmd;
+		rq.allowctx	= &rq;
+	}
 
+	/* A keep-alive connection may be idle for hdrtmo= seconds between
+	   requests. Then it is closed quietly. */
+	if (served++ && !awaitreq(tmo)) return 0;
+
+	/* Give up on clients which are too slow to send the request header,
+	   which is a way to hold connections open indefinitely. SIGALRM
+	   terminates the process since we don't handle it. */
+	alarm(tmo);
 	http_read_req(stdin, &rq, &out);
+	alarm(0);
+	fdb_finsh(&hdrenv);
+	if (rq.unauthd)
+		fprintf(stderr, "unauthorized request for %s from %s\n",
+			rs, rq.addr);
+	if (rq.addrdenied)
+		fprintf(stderr, "denied request for %s from %s\n", rs, rq.addr);
+
+	if (rq.unauthd)			METRIC_ADD(unauthd, 1);
+	else if (rq.addrdenied)		METRIC_ADD(addrdenied, 1);
+	else if (rq.error)		METRIC_ADD(badreqs, 1);
+	else if (rq.validws)		METRIC_ADD(websockets, 1);
+
+	/* Don't log the end of a keep-alive connection as a bad request. */
+	if (rq.error && !(feof(stdin) && !*rs)) logaccess(&rq, 0);
 	if (rq.error) return 0;
-	if (rq.validws) becomewebsocket(rq.query);
+
+	/* Let CGI scripts and new sessions know who is logged in, and from
+	   where. */
+	if (*rq.user)	setenv("REMOTE_USER", rq.user, 1);
+	else		unsetenv("REMOTE_USER");
+	setenv("REMOTE_ADDR", rq.addr, 1);
+	if (*rq.protocol)	setenv("WS_PROTOCOL", rq.protocol, 1);
+	else			unsetenv("WS_PROTOCOL");
+
+	if (rq.validws) {
+		if (rq.pmdeflate)
+			wbsoc_deflate(rq.deflate, rq.deflatebits,
+				      rq.deflatereset);
+		logaccess(&rq, 0);
+		becomewebsocket(&rq);
+	}
 
 	/* TODO(github.com/google/werm/issues/1) will it be more secure to also
 	   verify Origin/Host are consistent? */
@@ -1832,6 +3806,7 @@ int http_serv(void)
 	else
 		httphandlers(&out, &rq);
 
+	logaccess(&rq, 0);
 	return rq.keepaliv;
 }
 
@@ -1853,6 +3828,43 @@ er:
 	exit(1);
 }
 
+static int checkpath(const char *nm, const char *path, int mode)
+{
+	if (!path || !access(path, mode)) return 1;
+	warn("%s=%s", nm, path);
+	return 0;
+}
+
+/* Reports problems with the settings and listener addresses without starting
+   the server, and exits with status 1 if there are any. */
+static void _Noreturn checkconfig(char **addrs)
+{
+	int probs = 0;
+
+	probs += !loadflagsfile();
+	processquerystr(getenv("WERMFLAGS"));
+	probs += badflags;
+
+	probs += !checkpath("htpasswd",		htpasswd,	R_OK);
+	probs += !checkpath("authtokenfile",	authtokenfile,	R_OK);
+	probs += !checkpath("authcmd",		authcmd,	X_OK);
+	probs += !checkpath("onconnect",	onconnect,	X_OK);
+	probs += !checkpath("ondisconnect",	ondisconnect,	X_OK);
+	probs += !checkpath("motd",		motd,		R_OK);
+	probs += !checkpath("castdir",		castdir,	W_OK | X_OK);
+	probs += !cidrsok();
+
+	/* Exits on error, but does not bind anything. */
+	if (*addrs) parse_spawner_ports(addrs);
+
+	if (probs) {
+		printf("%d problem(s) found\n", probs);
+		exit(1);
+	}
+	puts("configuration OK");
+	exit(0);
+}
+
 int main(int argc, char **argv)
 {
 	Dtachctx dc;
@@ -1876,17 +3888,23 @@ int main(int argc, char **argv)
 	argc--;
 	argv++;
 	if (1 == argc && !strcmp(*argv, "test"))	testmain();
+	if (argc >= 1 && !strcmp(*argv, "check"))	checkconfig(argv + 1);
 
 	wts.allowtmstate = 1;
 
 	if (argc >= 1 && !strcmp(*argv, "spawner")) {
+		if (!loadflagsfile()) exit(1);
 		processquerystr(getenv("WERMFLAGS"));
+		if (!cidrsok()) exit(1);
 		iterprofs(profpath(), &((struct iterprofspec){ .diaglog = 1 }));
 
 		termid = strdup("~spawner");
 		appendunqid();
 		dc = prepfordtach();
 		dc->spargs = parse_spawner_ports(argv + 1);
+		/* The spawner never has attached clients, but must keep
+		   running. */
+		dc->detachtmo = dc->idletmo = 0;
 
 		fprintf(stderr,
 "--- WARNING ---\n"
@@ -55,3 +55,15 @@ prepare:
 	setenv("WERMVARDIR", rd, 1);
 	return rd;
 }
+
+int inlist(const char *list, const char *w)
+{
+	size_t wl = strlen(w), el;
+
+	for (;;) {
+		el = strcspn(list, ",");
+		if (el == wl && !strncmp(list, w, wl)) return 1;
+		if (!list[el]) return 0;
+		list += el + 1;
+	}
+}
@@ -28,11 +28,47 @@ struct clistate {
 	/* Whether the client wants to receive terminal output and state
 	   updates. */
 	unsigned wantsoutput : 1;
+
+	/* Whether the client asked to pause terminal output. The master stops
+	   reading from the subprocess while any client is paused. */
+	unsigned pausd : 1;
+
+	/* Whether the client only observes the session, so its keyboard input
+	   and changes to the window size, title, and tags are ignored. */
+	unsigned readonly : 1;
+
+	/* When the reply to the client's latest latency probe was queued, in ms
+	   on the monotonic clock, or 0 if the client has acknowledged it. */
+	long long pongat;
 };
 
 /* Whether the dtach component is logging. */
 int dtach_logging(void);
 
+/* Seconds a websocket frame write may block before the connection is dropped,
+   or 0 for no limit. */
+int wbsoc_wrtmo(void);
+
+/* Most bytes a websocket client may send in one message, or 0 for no limit. */
+long long wbsoc_maxmsg(void);
+
+/* Sets the seconds a websocket client may be quiet before it is pinged, and
+   how long it then has to answer before the connection is closed. An interval
+   of 0 means no pings are sent. */
+void wbsoc_pings(int *intvl, int *tmo);
+
+/* Sets how many bytes of output may be queued for a client which is not
+   keeping up, and whether more output is dropped for that client, rather than
+   not reading more output from the session until it catches up. */
+void slowcli_policy(size_t *maxbuf, int *drop);
+
+/* Sets the TCP keepalive idle time, probe interval, and probe count to use for
+   listeners which do not specify them. 0 means the system default. */
+void tcp_keepalive_dflt(int *idle, int *intvl, int *cnt);
+
+/* Returns the time in ms on the monotonic clock. */
+long long msnow(void);
+
 void _Noreturn subproc_main(Dtachctx dc);
 
 /* Processes output from the subprocess and writes the client output into
@@ -40,11 +76,16 @@ void _Noreturn subproc_main(Dtachctx dc);
 extern struct fdbuf therout;
 void process_tty_out(void *buf, ssize_t len);
 
+/* Checks whether the subprocess turned terminal echo on or off since the last
+   call, and if so writes an \@echo message into therout. Does nothing unless a
+   client has asked for echo hints. */
+void snoop_echo(int ptyfd);
+
 /* ptyfd is the pseudo-terminal that controls the terminal-enabled process.
  * There is only one per master. vt100 keyboard input data is sent to this fd.
- * clioutfd is where output is sent to the attached client. This is used for
+ * cliout is where output for the attached client is appended. This is used for
  * status updates (like the title) if needed. */
-void process_kbd(int clioutfd, Dtachctx dc, struct clistate *cls,
+void process_kbd(struct fdbuf *cliout, Dtachctx dc, struct clistate *cls,
 		 unsigned char *buf, size_t bufsz);
 
 /* role is a single character that identifies the role (e.g. master or
@@ -56,14 +97,18 @@ void send_pream(int fd);
 
 /* Called by master process. This must only be called by master, and never by
  * the attaching process, as the attaching process may have a later date on it
- * and thus create a new log file that doesn't get written to. */
-void open_logs(void);
+ * and thus create a new log file that doesn't get written to. Ephemeral
+ * sessions only get the castdir= recording, not scrollback logs. */
+void open_logs(int isephem);
 
 /* Allocates a new string of sufficient size and prints a formatted string to
  * it. Returns the length of the new string. */
 int xasprintf(char **strp, const char *format, ...)
 	__attribute__((format (printf, 2, 3)));
 
+/* Returns whether w is one of the entries in a comma-separated list. */
+int inlist(const char *list, const char *w);
+
 /* Returns a directory used to store state the persists across reboots and
  * server instances. */
 const char *state_dir(void);
@@ -76,4 +121,8 @@ char *next_uniqid(void);
    continue serving requests. */
 int http_serv(void);
 
+/* Reads the WERMFLAGSFILE and WERMFLAGS settings again. Settings which are no
+   longer given go back to their defaults. */
+void reload_flags(void);
+
 #endif
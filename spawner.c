@@ -5,6 +5,7 @@
  * https://developers.google.com/open-source/licenses/bsd */
 
 #include "spawner.h"
+#include "metrics.h"
 #include "shared.h"
 
 #include <sys/stat.h>
@@ -12,11 +13,19 @@
 #include <errno.h>
 #include <sys/select.h>
 #include <netinet/in.h>
+#include <netinet/tcp.h>
 #include <stdio.h>
+#include <stddef.h>
 #include <stdlib.h>
+#include <string.h>
 #include <sys/un.h>
 #include <arpa/inet.h>
 #include <sys/wait.h>
+#include <sys/socket.h>
+#include <signal.h>
+#include <time.h>
+#include <pwd.h>
+#include <grp.h>
 
 struct sock {
 	void *a;
@@ -25,9 +34,44 @@ struct sock {
 
 	unsigned reus : 1;
 
+	/* Options set on each accepted connection. Zero values leave the
+	   system default in place. */
+	unsigned nodelay : 1;
+	int sndbuf, rcvbuf, keepidle, keepintvl, keepcnt;
+
+	/* If rate is set, each client address may open this many connections
+	   per minute, and up to burst connections at once. */
+	int rate, burst;
+
+	/* If set, the most connections which may be open at once on this
+	   listener, and from each client address. */
+	int conns, addrconns;
+
+	/* Permissions and owner for a Unix socket. A zero mode and -1 ids are
+	   left alone. */
+	mode_t mode;
+	uid_t uid;
+	gid_t gid;
+
 	int fd;
 };
 
+/* Token buckets for rate-limiting connections, keyed by client address. When
+   the table is full, the least recently used address is forgotten. */
+static struct bucket {
+	unsigned char a[16];
+	double tok;
+	struct timespec last;
+} buckets[512];
+
+/* Connections being served by child processes, on listeners which limit them.
+   Unused slots have a zero pid. */
+static struct kid {
+	pid_t pid;
+	struct sock *s;
+	unsigned char a[16];
+} kids[1024];
+
 struct subproc_args {
 	struct sock sk[FD_SETSIZE];
 	unsigned nr, maxsfd;
@@ -40,9 +84,41 @@ static int setreuse(struct sock *s)
 	return setsockopt(s->fd, SOL_SOCKET, SO_REUSEADDR, &radr, sizeof(radr));
 }
 
+/* Removes a Unix socket left behind by a server which is no longer running, so
+   it can be bound again. */
+static void rmstale(struct sock *s)
+{
+	const char *path = ((struct sockaddr_un *) s->a)->sun_path;
+	struct stat sb;
+	int fd;
+
+	if (lstat(path, &sb) || !S_ISSOCK(sb.st_mode)) return;
+	if (0 > (fd = socket(AF_UNIX, SOCK_STREAM, 0))) return;
+
+	if (0 > connect(fd, s->a, s->sz) && errno == ECONNREFUSED) {
+		fprintf(stderr, "removing stale socket: %s\n", path);
+		if (0 > unlink(path)) perror("unlink stale socket");
+	}
+	close(fd);
+}
+
+static int setperms(struct sock *s)
+{
+	const char *path = ((struct sockaddr_un *) s->a)->sun_path;
+
+	if (s->mode && 0 > chmod(path, s->mode))
+		{ perror("chmod socket"); return 0; }
+	if ((s->uid != -1 || s->gid != -1) && 0 > chown(path, s->uid, s->gid))
+		{ perror("chown socket"); return 0; }
+	return 1;
+}
+
 static int prepsock(struct sock *s)
 {
 	struct sockaddr *sad = s->a;
+	int uds = sad->sa_family == AF_UNIX && *s->arg != '@';
+
+	if (uds) rmstale(s);
 
 	/* Must be non-blocking so that accept(2) will not block indefinitely
 	   for a flakey connection or other race conditions. */
@@ -51,6 +127,7 @@ static int prepsock(struct sock *s)
 	if (0>s->fd)			{ perror("open socket"	); goto er; }
 	if (0>setreuse(s))		{ perror("set REUSEADDR"); }
 	if (0>bind(s->fd, sad, s->sz))	{ perror("bind socket"	); goto er; }
+	if (uds && !setperms(s))			  goto er;
 	if (0>listen(s->fd, 4))		{ perror("listen socket"); goto er; }
 
 	if (s->fd >= FD_SETSIZE) {
@@ -73,6 +150,7 @@ static int adduds(const char *a, Ports ps)
 	struct sockaddr_un *addr;
 	const char pref[] = "[uds]:";
 	int preflen = 6;
+	socklen_t sz;
 
 	if (strncmp(pref, a, preflen)) return 0;
 	a += preflen;
@@ -82,10 +160,19 @@ static int adduds(const char *a, Ports ps)
 		return 0;
 	}
 
-	addr = malloc(sizeof(*addr));
+	addr = calloc(1, sizeof(*addr));
 	addr->sun_family = AF_UNIX;
 	strcpy(addr->sun_path, a);
-	ps->sk[ps->nr++] = (struct sock){addr, sizeof(*addr), strdup(a)};
+	sz = sizeof(*addr);
+
+	/* A name starting with @ is in Linux's abstract namespace, which has no
+	   file, and is given as a leading null byte and the exact length. */
+	if (*a == '@') {
+		*addr->sun_path = 0;
+		sz = offsetof(struct sockaddr_un, sun_path) + strlen(a);
+	}
+
+	ps->sk[ps->nr++] = (struct sock){addr, sz, strdup(a)};
 
 	return 1;
 }
@@ -158,15 +245,197 @@ static void delaystreamclose(void)
 	if (sl) nanosleep(&(struct timespec) {0, 500000000}, 0);
 }
 
+static void setintopt(int fd, int lvl, int nm, int val, const char *desc)
+{
+	if (!val) return;
+	if (0 > setsockopt(fd, lvl, nm, &val, sizeof(val))) perror(desc);
+}
+
+static void tunesock(struct sock *s, int fd)
+{
+	setintopt(fd, IPPROTO_TCP, TCP_NODELAY, s->nodelay, "set TCP_NODELAY");
+	setintopt(fd, SOL_SOCKET, SO_SNDBUF, s->sndbuf, "set SO_SNDBUF");
+	setintopt(fd, SOL_SOCKET, SO_RCVBUF, s->rcvbuf, "set SO_RCVBUF");
+
+	if (!s->keepidle && !s->keepintvl && !s->keepcnt) return;
+
+	setintopt(fd, SOL_SOCKET, SO_KEEPALIVE, 1, "set SO_KEEPALIVE");
+	setintopt(fd, IPPROTO_TCP, TCP_KEEPIDLE, s->keepidle,
+		  "set TCP_KEEPIDLE");
+	setintopt(fd, IPPROTO_TCP, TCP_KEEPINTVL, s->keepintvl,
+		  "set TCP_KEEPINTVL");
+	setintopt(fd, IPPROTO_TCP, TCP_KEEPCNT, s->keepcnt, "set TCP_KEEPCNT");
+}
+
+/* Returns the bucket for the address, taking over the least recently used one
+   if it has none. */
+static struct bucket *bucketfor(const unsigned char a[16])
+{
+	struct bucket *b, *lru = buckets;
+
+	for (b = buckets; b < buckets + sizeof(buckets)/sizeof(*b); b++) {
+		if (b->last.tv_sec && !memcmp(b->a, a, 16)) return b;
+		if (b->last.tv_sec < lru->last.tv_sec) lru = b;
+	}
+
+	memcpy(lru->a, a, 16);
+	lru->last.tv_sec = 0;
+	return lru;
+}
+
+/* Copies the IP address in sa to a, with IPv4 addresses in the first 4 bytes.
+   Returns 0 if it is not an IP address. */
+static int addrkey(struct sockaddr_storage *sa, unsigned char a[16])
+{
+	memset(a, 0, 16);
+	if (sa->ss_family == AF_INET)
+		memcpy(a, &((struct sockaddr_in *) sa)->sin_addr, 4);
+	else if (sa->ss_family == AF_INET6)
+		memcpy(a, &((struct sockaddr_in6 *) sa)->sin6_addr, 16);
+	else
+		return 0;
+	return 1;
+}
+
+/* Returns whether a connection from a is within the rate limit of s. */
+static int underrate(struct sock *s, const unsigned char a[16])
+{
+	struct bucket *b;
+	struct timespec now;
+	double el;
+	int burst = s->burst ? s->burst : s->rate;
+
+	if (!s->rate) return 1;
+
+	clock_gettime(CLOCK_MONOTONIC, &now);
+	b = bucketfor(a);
+
+	if (!b->last.tv_sec)
+		b->tok = burst;
+	else {
+		el = now.tv_sec - b->last.tv_sec
+		   + (now.tv_nsec - b->last.tv_nsec) / 1e9;
+		b->tok += el * s->rate / 60;
+		if (b->tok > burst) b->tok = burst;
+	}
+	b->last = now;
+
+	if (b->tok < 1) return 0;
+	b->tok--;
+	return 1;
+}
+
+/* Returns whether s can take another connection from a without going over its
+   limits on concurrent connections, or a free slot in kids to track it. */
+static int underconns(struct sock *s, const unsigned char a[16], int isip)
+{
+	struct kid *k;
+	int all = 0, fromaddr = 0, slot = 0;
+
+	if (!s->conns && !s->addrconns) return 1;
+
+	for (k = kids; k < kids + sizeof(kids)/sizeof(*kids); k++) {
+		if (!k->pid)		{ slot = 1; continue; }
+		if (k->s != s)		continue;
+		all++;
+		if (isip && !memcmp(k->a, a, 16)) fromaddr++;
+	}
+
+	if (!slot)					return 0;
+	if (s->conns && all >= s->conns)		return 0;
+	if (isip && s->addrconns && fromaddr >= s->addrconns)	return 0;
+	return 1;
+}
+
+static void trackkid(struct sock *s, const unsigned char a[16], pid_t pid)
+{
+	struct kid *k;
+
+	if (!s->conns && !s->addrconns) return;
+
+	for (k = kids; k < kids + sizeof(kids)/sizeof(*kids); k++) {
+		if (k->pid) continue;
+		*k = (struct kid){pid, s};
+		memcpy(k->a, a, 16);
+		return;
+	}
+}
+
+static void reapkids(void)
+{
+	struct kid *k;
+	pid_t pid;
+	int st;
+
+	while (0 < (pid = waitpid(-1, &st, WNOHANG))) {
+		for (k = kids; k < kids + sizeof(kids)/sizeof(*kids); k++)
+			if (k->pid == pid) k->pid = 0;
+
+		metrics_releaseconn(pid);
+		METRIC_ADD(active, -1);
+		if (!WIFEXITED(st) || WEXITSTATUS(st)) METRIC_ADD(failexits, 1);
+	}
+}
+
+/* Sends an error response which does not depend on the request, and closes the
+   connection. */
+static void refuse(int fd, struct sockaddr_storage *sa, const char *resp,
+		   const char *why)
+{
+	char ad[INET6_ADDRSTRLEN] = "local";
+
+	if (sa->ss_family == AF_INET)
+		inet_ntop(AF_INET, &((struct sockaddr_in *) sa)->sin_addr,
+			  ad, sizeof(ad));
+	if (sa->ss_family == AF_INET6)
+		inet_ntop(AF_INET6, &((struct sockaddr_in6 *) sa)->sin6_addr,
+			  ad, sizeof(ad));
+	fprintf(stderr, "%s connection from %s\n", why, ad);
+
+	/* Don't block the spawner for a client that isn't reading. */
+	send(fd, resp, strlen(resp), MSG_DONTWAIT | MSG_NOSIGNAL);
+	close(fd);
+}
+
+static volatile sig_atomic_t reloadreq;
+
+static void onhup(int sig) { reloadreq = 1; }
+
 static void handlreq(Ports ps, struct sock *s)
 {
 	pid_t cpid;
+	struct sockaddr_storage sa;
+	socklen_t sl = sizeof(sa);
+	unsigned char a[16];
+	int isip;
 
-	int fd = accept(s->fd, 0, 0);
+	int fd = accept(s->fd, (struct sockaddr *) &sa, &sl);
 
 	if (0 > fd)			{ perror("accept"	); goto er; }
+
+	isip = addrkey(&sa, a);
+	if (isip && !underrate(s, a)) {
+		refuse(fd, &sa, "HTTP/1.1 429 Too Many Requests\r\n"
+				"Connection: close\r\n"
+				"Content-Length: 0\r\n\r\n", "rate-limited");
+		METRIC_ADD(ratelimited, 1);
+		return;
+	}
+	if (!underconns(s, a, isip)) {
+		refuse(fd, &sa, "HTTP/1.1 503 Service Unavailable\r\n"
+				"Connection: close\r\n"
+				"Retry-After: 10\r\n"
+				"Content-Length: 0\r\n\r\n", "over-limit");
+		METRIC_ADD(overlimit, 1);
+		return;
+	}
+
 	if (0 > (cpid=fork()))		{ perror("fork"		); goto er; }
 	if (cpid) {
+		trackkid(s, a, cpid);
+		METRIC_ADD(conns, 1);
+		METRIC_ADD(active, 1);
+
 		/* If we leak any instances of this fd in the parent proc,
 		   the connection will never close. */
 		if (0>close(fd))	{ perror("close"	); goto er; }
@@ -175,12 +444,18 @@ static void handlreq(Ports ps, struct sock *s)
 	/* Allow Wera processes to survive after the spawner process is killed,
 	   which is usually done for debugging and development. */
 	setsid();
+	signal(SIGHUP, SIG_DFL);
 
 	closeports(ps);
+	tunesock(s, fd);
 
 	if (0 > dup2(fd, 0))		{ perror("dup2 stdin"	); goto er; }
 	if (0 > dup2(fd, 1))		{ perror("dup2 stdout"	); goto er; }
 
+	/* Sessions started from this process must not inherit the socket, or
+	   the connection stays open after this process exits. */
+	if (fd > 1) close(fd);
+
 	while (http_serv()) {}
 	delaystreamclose();
 
@@ -211,7 +486,7 @@ static void acceptnext(Ports ps)
 		perror("select");
 		exit(1);
 	}
-	waitpid(-1, 0, WNOHANG);
+	reapkids();
 
 	sk = ps->sk + ps->nr;
 	while (sk-- != ps->sk) {
@@ -219,14 +494,111 @@ static void acceptnext(Ports ps)
 	}
 }
 
+static int optval(const char *o, const char *pref, int *dest)
+{
+	size_t plen = strlen(pref);
+	int len = -1;
+
+	if (strncmp(o, pref, plen)) return 0;
+	sscanf(o + plen, "%d%n", dest, &len);
+	return len > 0 && len == strlen(o + plen) && *dest > 0;
+}
+
+/* Parses an octal mode= option. */
+static int modeopt(const char *o, mode_t *dest)
+{
+	unsigned m;
+	int len = -1;
+
+	if (strncmp(o, "mode=", 5)) return 0;
+	sscanf(o + 5, "%o%n", &m, &len);
+	if (len <= 0 || len != strlen(o + 5) || m > 07777) return 0;
+	*dest = m;
+	return 1;
+}
+
+/* Parses an owner= option, which is a user name, user:group, or :group. */
+static int owneropt(const char *o, uid_t *uid, gid_t *gid)
+{
+	char *un, *gn;
+	struct passwd *pw;
+	struct group *gr;
+	int ok = 0;
+
+	if (strncmp(o, "owner=", 6)) return 0;
+	un = strdup(o + 6);
+	gn = strchr(un, ':');
+	if (gn) *gn++ = 0;
+
+	if (*un && !(pw = getpwnam(un))) {
+		fprintf(stderr, "unknown user: %s\n", un);
+		goto cleanup;
+	}
+	if (gn && !(gr = getgrnam(gn))) {
+		fprintf(stderr, "unknown group: %s\n", gn);
+		goto cleanup;
+	}
+	if (*un)	*uid = pw->pw_uid;
+	if (gn)		*gid = gr->gr_gid;
+	ok = 1;
+
+cleanup:
+	free(un);
+	return ok;
+}
+
+/* Parses the comma-separated options after the address, e.g.
+   127.0.0.1:8090,nodelay,sndbuf=65536 */
+static int addopts(char *o, struct sock *s)
+{
+	char *nm;
+	int tcp = ((struct sockaddr *) s->a)->sa_family != AF_UNIX;
+	int uds = !tcp && *s->arg != '@';
+
+	if (tcp) tcp_keepalive_dflt(&s->keepidle, &s->keepintvl, &s->keepcnt);
+	s->uid = -1;
+	s->gid = -1;
+
+	while (o) {
+		nm = o;
+		o = strchr(o, ',');
+		if (o) *o++ = 0;
+
+		if (tcp && !strcmp(nm, "nodelay")) { s->nodelay = 1; continue; }
+		if (optval(nm, "sndbuf=",	&s->sndbuf	)) continue;
+		if (optval(nm, "rcvbuf=",	&s->rcvbuf	)) continue;
+		if (tcp && optval(nm, "keepidle=",	&s->keepidle	)) continue;
+		if (tcp && optval(nm, "keepintvl=",	&s->keepintvl	)) continue;
+		if (tcp && optval(nm, "keepcnt=",	&s->keepcnt	)) continue;
+		if (optval(nm, "rate=",		&s->rate	)) continue;
+		if (optval(nm, "burst=",	&s->burst	)) continue;
+		if (optval(nm, "conns=",	&s->conns	)) continue;
+		if (optval(nm, "addrconns=",	&s->addrconns	)) continue;
+		if (uds && modeopt(nm, &s->mode))		continue;
+		if (uds && owneropt(nm, &s->uid, &s->gid))	continue;
+
+		fprintf(stderr, "invalid listener option: %s\n", nm);
+		return 0;
+	}
+
+	return 1;
+}
+
 Ports parse_spawner_ports(char **argv)
 {
 	Ports ps = calloc(sizeof(*ps), 1);
+	char *a, *opts;
 
 	for (; *argv; argv++) {
-		if (adduds(*argv, ps)) continue;
-		if (addip4(*argv, ps)) continue;
-		if (addip6(*argv, ps)) continue;
+		a = strdup(*argv);
+		opts = strchr(a, ',');
+		if (opts) *opts++ = 0;
+
+		if (	(adduds(a, ps) || addip4(a, ps) || addip6(a, ps))
+		    &&	addopts(opts, ps->sk + ps->nr - 1)) {
+			free(a);
+			continue;
+		}
 
 		fprintf(stderr, "can't open socket for addr:port: %s\n", *argv);
 		exit(1);
@@ -249,5 +621,16 @@ void _Noreturn spawner(Ports ps)
 		if (prepsock(sk) && ps->maxsfd < sk->fd) ps->maxsfd = sk->fd;
 	}
 
-	for (;;) acceptnext(ps);
+	/* select(2) is interrupted by the signal, since SA_RESTART is not
+	   set. */
+	sigaction(SIGHUP, &(struct sigaction){.sa_handler = onhup}, 0);
+	metrics_init();
+
+	for (;;) {
+		acceptnext(ps);
+		if (!reloadreq) continue;
+
+		reloadreq = 0;
+		reload_flags();
+	}
 }
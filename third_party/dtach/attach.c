@@ -18,6 +18,19 @@
 
 /* WERM-SPECIFIC MODIFICATIONS
 
+ OCT 2026
+
+ - ping the client when it is quiet, and exit if it stops answering
+
+ - tell the master when the client only observes the session
+
+ - exit cleanly when the client closes the websocket, or keep relaying output
+   until the session ends if dc->draincli is set
+
+ - hold back output which ends in the middle of an escape or UTF-8 sequence
+   until the rest arrives, so websocket frames do not split them. Held bytes
+   are sent anyway 100ms after they were first held
+
  JAN 2024
 
  - attach_main takes Dtachctx as an argument
@@ -162,7 +175,10 @@ void attach_main(Dtachctx dc, int noerror)
 {
 	unsigned char buf[BUFSIZE];
 	fd_set readfds;
-	int s;
+	int s, clifin = 0, ka;
+	size_t held = 0, cut;
+	long long holdend = 0, left;
+	struct timeval holdtmo, katmo, *tmo;
 
 	set_argv0(dc, 'a');
 
@@ -181,6 +197,7 @@ void attach_main(Dtachctx dc, int noerror)
 	signal(SIGQUIT, die);
 
 	/* Tell the master that we want to attach by sending a no-op signal. */
+	if (dc->observe) write(s, "\\O", 2);
 	write(s, "\\N", 2);
 
 	/* Wait for things to happen */
@@ -189,30 +206,68 @@ void attach_main(Dtachctx dc, int noerror)
 		int n;
 
 		FD_ZERO(&readfds);
-		FD_SET(0, &readfds);
+		if (!clifin) FD_SET(0, &readfds);
 		FD_SET(s, &readfds);
-		n = select(s + 1, &readfds, NULL, NULL, NULL);
+
+		/* Don't hold back output for long if the rest of a sequence
+		** never arrives. */
+		if (held) {
+			left = holdend - msnow();
+			if (left < 0) left = 0;
+			holdtmo = (struct timeval){left / 1000, left % 1000 * 1000};
+		}
+		ka = clifin ? -1 : wbsoc_keepalive();
+		katmo = (struct timeval){ka, 0};
+		tmo = held ? &holdtmo : ka >= 0 ? &katmo : NULL;
+		n = select(s + 1, &readfds, NULL, NULL, tmo);
 		if (n < 0 && errno != EINTR && errno != EAGAIN)
 			exit_msg("e", "select syscall failed: ", errno);
 
+		if (n == 0)
+		{
+			write_wbsoc_frame(buf, held);
+			held = 0;
+		}
+
 		/* Pty activity */
 		if (n > 0 && FD_ISSET(s, &readfds))
 		{
-			ssize_t len = read(s, buf, sizeof(buf));
+			ssize_t len = read(s, buf + held, sizeof(buf) - held);
 
 			if (len == 0)
+			{
+				write_wbsoc_frame(buf, held);
+				if (clifin == 'c') {
+					write_wbsoc_close(1000);
+					exit(0);
+				}
 				exit_msg("", "EOF - dtach terminating", -1);
+			}
 			if (len < 0)
 				exit_msg("e", "read syscall failed: ", errno);
 
-			/* Send the data to the terminal. */
-			write_wbsoc_frame(buf, len);
+			/* Send the data to the terminal, except for an
+			** incomplete sequence at the end. */
+			len += held;
+			cut = rout_cutlen(buf, len);
+			if (!cut && len == sizeof(buf))
+				cut = len;
+			write_wbsoc_frame(buf, cut);
+			/* The bytes held before were sent, so any held now are
+			** new. */
+			if (cut >= held) holdend = msnow() + 100;
+			held = len - cut;
+			memmove(buf, buf + cut, held);
 			n--;
 		}
 		/* stdin activity */
 		if (n > 0 && FD_ISSET(0, &readfds))
 		{
-			fwrd_inbound_frames(s);
+			clifin = fwrd_inbound_frames(s);
+			if (clifin && !dc->draincli) {
+				if (clifin == 'c') write_wbsoc_close(1000);
+				exit(0);
+			}
 			n--;
 		}
 	}
@@ -18,6 +18,13 @@
 
 /* WERM-SPECIFIC MODIFICATIONS
 
+ OCT 2026
+
+ - do not start a session for a client which only observes
+
+ - set dc->lostprev when replacing a session whose dc->runmark was left
+   behind
+
  NOV 2023
 
  - attach_main is void instead of int and does not return at all on error
@@ -50,10 +57,12 @@ dtach_main(Dtachctx dc)
 	/* Try to attach first. If that doesn't work, create a new socket. */
 	attach_main(dc, 1);
 
+	if (dc->observe) exit_msg("e", "session is not running", -1);
+
 	if (errno == ECONNREFUSED || errno == ENOENT)
 	{
-		if (errno == ECONNREFUSED)
-			unlink(dc->sockpath);
+		if (errno == ECONNREFUSED) unlink(dc->sockpath);
+		dc->lostprev = dc->runmark && !unlink(dc->runmark);
 		if (dtach_master(dc) != 0)
 			exit(1);
 	}
@@ -18,6 +18,38 @@
 
 /* WERM-SPECIFIC MODIFICATIONS
 
+ OCT 2026
+
+ - queue output for each client which cannot take it right away, up to a limit,
+   rather than dropping what a blocked client did not take. Past the limit,
+   either stop reading the pty or drop the client's output with a notice,
+   depending on werm configuration. Replaces sendrout. Replies to a client's
+   messages are queued behind its output too. Read-only clients always have
+   their output dropped, so they cannot stop the pty from being read
+
+ - record when the session started
+
+ - utility for checking whether any client is attached: has_atch_clis
+
+ - call open_logs for ephemeral sessions too, so they can be recorded
+
+ - do not read from the pty while an attached client has paused output
+
+ - check for changes to the pty's echo setting after reading its output
+
+ - send pty output which is still unread to clients after the child exits, and
+   when the pty is closed, keep serving clients for up to dc->exitwait seconds
+   while the child exits instead of aborting
+
+ - record the time of the last pty output in dc->lastout
+
+ - end the session when it has been detached or idle for longer than
+   dc->detachtmo or dc->idletmo seconds, and log it to the original stderr
+
+ - delete the socket when the child exits, so only a killed master leaves it
+   behind. Keep a dc->runmark file while a persistent session runs, and delete
+   it too, since older versions left the socket behind after a normal exit
+
  JAN 2024
 
  - move ownership of clients linked list to Dtachctx and refactor references to
@@ -93,6 +125,14 @@
 #include "outstreams.h"
 #include "shared.h"
 #include <sys/wait.h>
+#include <limits.h>
+
+/* Where to log session events, like ending a stale session. */
+static int evfd = -1;
+
+/* Once the pty is closed, when the child must have exited by, in ms on the
+   monotonic clock. 0 while the pty is open. */
+static long long exitby;
 
 /* A connected client */
 struct client
@@ -105,6 +145,9 @@ struct client
 	int fd;
 
 	struct clistate cls;
+
+	/* Output the client has not taken yet because it is slow. */
+	struct fdbuf pend;
 };
 
 /* Signal */
@@ -187,104 +230,197 @@ create_socket(char *name)
 	return s;
 }
 
-/* Returns:
-   'b' if writing would block
-   'e' if unexpected error
-   'o' if all written OK */
-static int cliwrite(int fd, const unsigned char *b, size_t sz)
+/* Writes as much as the client takes without blocking. Returns how many bytes
+   were written, or -1 on an unexpected error. */
+static ssize_t cliwrite(int fd, const unsigned char *b, size_t sz)
 {
 	ssize_t writn;
+	size_t done = 0;
 
-	while (sz) {
-		writn = write(fd, b, sz);
+	while (done < sz) {
+		writn = write(fd, b + done, sz - done);
 
-		if (writn > 0) {
-			sz -= writn;
-			b += writn;
-		}
+		if (writn > 0)
+			done += writn;
 		else if (errno == EAGAIN || errno == EWOULDBLOCK)
-			return 'b';
+			break;
 		else {
 			perror("writing to client");
 			fprintf(stderr, "  fd: %d\n", fd);
-			fprintf(stderr, "  size: %zu\n", sz);
-			return 'e';
+			fprintf(stderr, "  size: %zu\n", sz - done);
+			return -1;
 		}
 	}
 
-	return 'o';
+	return done;
 }
 
-static int sendrout(Dtachctx dc, fd_set *writabl)
+/* Sends output to a client, queueing what it does not take right away. */
+static void
+queueout(struct client *p, const unsigned char *b, size_t sz)
+{
+	ssize_t writn = 0;
+	size_t max;
+	int drop;
+	unsigned char *nl;
+
+	if (!p->pend.len && (writn = cliwrite(p->fd, b, sz)) < 0) return;
+	fdb_apnd(&p->pend, b + writn, sz - writn);
+
+	/* Observers always get the drop policy, so they cannot hold up the
+	   session. */
+	slowcli_policy(&max, &drop);
+	if ((!drop && !p->cls.readonly) || p->pend.len <= max) return;
+
+	/* Keep the rest of the chunk the client has started getting, so it
+	   does not see a broken escape. Cancel any terminal escape sequence
+	   which it was in before showing the notice. */
+	nl = memchr(p->pend.bf, '\n', p->pend.len);
+	if (nl) p->pend.len = nl - p->pend.bf + 1;
+	fdb_routs(&p->pend,
+		  "\030\r\n[output dropped: the connection is too slow]\r\n",
+		  -1);
+	fdb_apnc(&p->pend, '\n');
+}
+
+/* Writes as much of the client's queued output as it takes without blocking. */
+static void
+flushpend(struct client *p)
+{
+	ssize_t writn = cliwrite(p->fd, p->pend.bf, p->pend.len);
+
+	if (writn < 0) writn = p->pend.len;
+	p->pend.len -= writn;
+	memmove(p->pend.bf, p->pend.bf + writn, p->pend.len);
+}
+
+/* Returns whether the pty should not be read because a client which controls
+   the session has too much output queued. */
+static int
+outbehind(Dtachctx dc)
 {
 	struct client *p;
-	int nclients;
+	size_t max;
+	int drop;
+
+	slowcli_policy(&max, &drop);
+	if (drop) return 0;
 
-	/* Send the data out to the clients. */
-	for (p = dc->cls, nclients = 0; p; p = p->next) {
-		if (!FD_ISSET(p->fd, writabl)) continue;
+	for (p = dc->cls; p; p = p->next)
+		if (p->cls.wantsoutput && !p->cls.readonly && p->pend.len >= max)
+			return 1;
+	return 0;
+}
 
-		switch (cliwrite(p->fd, therout.bf, therout.len)) {
-		default: abort();
-		case 'b': break;
-		case 'e': nclients = -1;
-		case 'o': if (nclients != -1) nclients++;
+/* Gives slow clients a few seconds to take the output queued for them. */
+static void
+flushall(Dtachctx dc)
+{
+	struct client *p;
+	fd_set writefds;
+	struct timeval tmo;
+	int highest_fd;
+
+	for (;;) {
+		FD_ZERO(&writefds);
+		highest_fd = -1;
+		for (p = dc->cls; p; p = p->next) {
+			if (!p->pend.len) continue;
+			FD_SET(p->fd, &writefds);
+			if (p->fd > highest_fd) highest_fd = p->fd;
 		}
+		if (highest_fd < 0) return;
+
+		tmo = (struct timeval){5, 0};
+		if (select(highest_fd + 1, NULL, &writefds, NULL, &tmo) < 1)
+			return;
+
+		for (p = dc->cls; p; p = p->next)
+			if (FD_ISSET(p->fd, &writefds)) flushpend(p);
 	}
+}
 
-	return nclients;
+/* Returns whether an attached client has asked for output to be paused. */
+static int
+outpausd(Dtachctx dc)
+{
+	struct client *p;
+
+	for (p = dc->cls; p; p = p->next)
+		if (p->cls.wantsoutput && p->cls.pausd) return 1;
+	return 0;
 }
 
 /* Process activity on the pty - Input and terminal changes are sent out to
-** the attached clients. If the pty goes away, we die. */
-static void
-pty_activity(Dtachctx dc, int s)
+** the attached clients. Returns 0 if the pty went away. */
+static int
+pty_activity(Dtachctx dc)
 {
 	unsigned char preprocb[BUFSIZE];
 	struct client *p;
-	fd_set readfds, writefds;
-	int highest_fd, nclients, preproclen;
+	int preproclen;
 
 	/* Read the pty activity */
 	preproclen = read(dc->the_pty.fd, preprocb, sizeof(preprocb));
 
-	/* Error -> die */
-	if (preproclen <= 0) {
+	/* EIO means every process has closed the pty */
+	if (preproclen == 0 || (preproclen < 0 && errno == EIO))
+		return 0;
+	if (preproclen < 0) {
 		perror("read pty");
 		abort();
 	}
 
+	dc->lastout = time(0);
+
 	therout.len = 0;
 	if (!therout.cap) therout.cap = 1024;
 	process_tty_out(preprocb, preproclen);
+	snoop_echo(dc->the_pty.fd);
+
+	for (p = dc->cls; p; p = p->next)
+		if (p->cls.wantsoutput) queueout(p, therout.bf, therout.len);
+
+	return 1;
+}
+
+/* Sends output which the child wrote before exiting but was not read yet. */
+static void
+drainpty(Dtachctx dc)
+{
+	fd_set readfds;
+	struct timeval tmo;
 
 	do {
-		/*
-		** Wait until at least one client is writable. Also wait on the
-		** control socket in case a new client tries to connect.
-		*/
 		FD_ZERO(&readfds);
-		FD_ZERO(&writefds);
-		FD_SET(s, &readfds);
-		highest_fd = s;
-		for (p = dc->cls, nclients = 0; p; p = p->next)
-		{
-			if (!p->cls.wantsoutput)
-				continue;
-			FD_SET(p->fd, &writefds);
-			if (p->fd > highest_fd)
-				highest_fd = p->fd;
-			nclients++;
-		}
-		if (nclients == 0)
-			break;
-		if (select(highest_fd + 1, &readfds, &writefds, NULL, NULL) < 0)
-			break;
+		FD_SET(dc->the_pty.fd, &readfds);
+		tmo = (struct timeval){0, 0};
+		if (select(dc->the_pty.fd + 1, &readfds, NULL, NULL, &tmo) < 1)
+			return;
+	}
+	while (pty_activity(dc));
+}
 
-		nclients = sendrout(dc, &writefds);
+/* Ends a session whose child exited or was hung up. The socket and runmark
+   are removed so that a runmark left behind means the master was killed. */
+static _Noreturn void
+endsession(Dtachctx dc)
+{
+	flushall(dc);
+	unlink(dc->sockpath);
+	if (dc->runmark) unlink(dc->runmark);
+	exit(0);
+}
 
-		/* Try again if nothing happened. */
-	} while (!FD_ISSET(s, &readfds) && nclients == 0);
+/* Called when the pty is closed but the child may still be running. The
+   session ends now if it is not, or else once it exits or dc->exitwait seconds
+   pass. */
+static void
+ptyclosed(Dtachctx dc)
+{
+	if (waitpid(dc->the_pty.pid, 0, WNOHANG) || dc->exitwait <= 0)
+		endsession(dc);
+	exitby = msnow() + dc->exitwait * 1000LL;
 }
 
 /* Process activity on the control socket */
@@ -330,18 +466,33 @@ void print_atch_clis(Dtachctx dc, struct fdbuf *b)
 	fdb_apnc(b, ']');
 }
 
+int has_atch_clis(Dtachctx dc)
+{
+	struct client *p;
+
+	for (p = dc->cls; p; p = p->next)
+		if (p->cls.wantsoutput) return 1;
+	return 0;
+}
+
 /* Process activity from a client. */
 static void
 client_activity(Dtachctx dc, struct client *p)
 {
 	ssize_t len;
 	unsigned char buf[512];
+	struct fdbuf rep = {0};
 
 	/* Read the activity. */
 	len = read(p->fd, buf, sizeof(buf));
 	if (len < 0 && (errno == EAGAIN || errno == EINTR))
 		return;
 
+	if (p->cls.wantsoutput) {
+		if (len > 0)	dc->lastin = time(0);
+		else		dc->lastatch = time(0);
+	}
+
 	/* Close the client on an error. */
 	if (len <= 0)
 	{
@@ -349,13 +500,58 @@ client_activity(Dtachctx dc, struct client *p)
 		if (p->next)
 			p->next->pprev = p->pprev;
 		*(p->pprev) = p->next;
+		free(p->pend.bf);
 		free(p);
 		return;
 	}
-	process_kbd(p->fd, dc, &p->cls, buf, len);
+
+	/* Queue replies behind any output the client has not taken yet. */
+	process_kbd(&rep, dc, &p->cls, buf, len);
+	if (rep.len) queueout(p, rep.bf, rep.len);
+	fdb_finsh(&rep);
+}
+
+/* Returns the seconds left until the session is stale and should be ended,
+   which may be negative, or INT_MAX if it will not be. Sets *why to the
+   reason it will be stale. */
+static int
+secstostale(Dtachctx dc, const char **why)
+{
+	time_t now = time(0);
+	time_t act = dc->lastout > dc->lastin ? dc->lastout : dc->lastin;
+	int left = INT_MAX, l;
+
+	if (dc->isephem || exitby) return left;
+
+	if (dc->detachtmo > 0 && !has_atch_clis(dc)) {
+		left = dc->lastatch + dc->detachtmo - now;
+		*why = "detached";
+	}
+	if (dc->idletmo > 0) {
+		l = act + dc->idletmo - now;
+		if (l < left) { left = l; *why = "idle"; }
+	}
+
+	return left;
+}
+
+/* Ends the session if it has been detached or idle for too long. Closing the
+   pty hangs up the controlled process. */
+static void
+reapifstale(Dtachctx dc)
+{
+	const char *why;
+
+	if (secstostale(dc, &why) > 0) return;
+
+	dprintf(evfd, "ending %s session %s, pid %d\n",
+		why, dc->sockpath, (int) dc->the_pty.pid);
+	close(dc->the_pty.fd);
+	kill(-dc->the_pty.pid, SIGHUP);
+	ptyclosed(dc);
 }
 
-static void handleselecterr(pid_t pty)
+static void handleselecterr(Dtachctx dc)
 {
 	int ern = errno;
 
@@ -364,7 +560,10 @@ static void handleselecterr(pid_t pty)
 
 	   For other child processes, such as /bin/bash, EIO seems to be
 	   given. */
-	if (0 <= waitpid(pty, 0, WNOHANG)) exit(0);
+	if (0 <= waitpid(dc->the_pty.pid, 0, WNOHANG)) {
+		if (!exitby) drainpty(dc);
+		endsession(dc);
+	}
 
 	if (ern == EINTR || ern == EAGAIN) return;
 
@@ -378,8 +577,11 @@ static _Noreturn void
 masterprocess(Dtachctx dc, int s)
 {
 	struct client *p, *next;
-	fd_set readfds;
-	int highest_fd, nullfd;
+	fd_set readfds, writefds;
+	int highest_fd, nullfd, stalein;
+	long long left;
+	struct timeval tmo;
+	const char *why;
 
 	/* Okay, disassociate ourselves from the original terminal, as we
 	** don't care what happens to it. */
@@ -400,11 +602,11 @@ masterprocess(Dtachctx dc, int s)
 	}
 	set_argv0(dc, 'm');
 
-	/* Do not save scrollbacks for ephemeral terminals, as these are
-	   used for grepping scrollback logs, so they can be very large
-	   and included redundant data that will be confusing to see in
+	/* open_logs does not save scrollbacks for ephemeral terminals, as
+	   these are used for grepping scrollback logs, so they can be very
+	   large and included redundant data that will be confusing to see in
 	   some recursive analysis of scrollbacks. */
-	if (!dc->isephem) open_logs();
+	open_logs(dc->isephem);
 
 	/* Set up some signals. */
 	signal(SIGPIPE, SIG_IGN);
@@ -415,6 +617,10 @@ masterprocess(Dtachctx dc, int s)
 	signal(SIGINT, die);
 	signal(SIGTERM, die);
 
+	/* Keep the original stderr, e.g. the spawner's scrollback, for events
+	** which should be logged even without dtachlog. */
+	evfd = fcntl(2, F_DUPFD_CLOEXEC, 3);
+
 	/* Make sure stdin/stdout/stderr point to /dev/null. We are now a
 	** daemon. */
 	nullfd = open("/dev/null", O_RDWR);
@@ -425,11 +631,14 @@ masterprocess(Dtachctx dc, int s)
 	if (nullfd > 2)
 		close(nullfd);
 
+	dc->started = dc->lastin = dc->lastatch = time(0);
+
 	/* Loop forever. */
 	while (1)
 	{
 		/* Re-initialize the file descriptor set for select. */
 		FD_ZERO(&readfds);
+		FD_ZERO(&writefds);
 		FD_SET(s, &readfds);
 		highest_fd = s;
 
@@ -442,7 +651,14 @@ masterprocess(Dtachctx dc, int s)
 			send_pream(dc->the_pty.fd);
 		}
 
-		if (dc->firstatch) {
+		/*
+		** Leave unread output in the pty while paused, or while a
+		** client is too far behind, so that the subprocess blocks
+		** rather than having its output dropped. Once the pty is
+		** closed, there is nothing more to read.
+		*/
+		if (!exitby && dc->firstatch
+		    && !outpausd(dc) && !outbehind(dc)) {
 			FD_SET(dc->the_pty.fd, &readfds);
 			if (dc->the_pty.fd > highest_fd)
 				highest_fd = dc->the_pty.fd;
@@ -451,13 +667,24 @@ masterprocess(Dtachctx dc, int s)
 		for (p = dc->cls; p; p = p->next)
 		{
 			FD_SET(p->fd, &readfds);
+			if (p->pend.len)
+				FD_SET(p->fd, &writefds);
 			if (p->fd > highest_fd)
 				highest_fd = p->fd;
 		}
 
-		/* Wait for something to happen. */
-		if (select(highest_fd + 1, &readfds, NULL, NULL, NULL) < 0) {
-			handleselecterr(dc->the_pty.pid);
+		/* Wait for something to happen, for the session to become
+		   stale, or for the child to take too long to exit. */
+		stalein = secstostale(dc, &why);
+		tmo = (struct timeval){stalein > 0 ? stalein : 0, 0};
+		if (exitby) {
+			left = exitby - msnow();
+			if (left < 0) left = 0;
+			tmo = (struct timeval){left / 1000, left % 1000 * 1000};
+		}
+		if (select(highest_fd + 1, &readfds, &writefds, NULL,
+			   stalein == INT_MAX && !exitby ? NULL : &tmo) < 0) {
+			handleselecterr(dc);
 			continue;
 		}
 
@@ -468,13 +695,20 @@ masterprocess(Dtachctx dc, int s)
 		for (p = dc->cls; p; p = next)
 		{
 			next = p->next;
+			if (FD_ISSET(p->fd, &writefds))
+				flushpend(p);
 			if (FD_ISSET(p->fd, &readfds))
 				client_activity(dc, p);
 		}
 		if (!dc->cls && dc->firstatch && dc->isephem) exit(0);
 		/* pty activity? */
-		if (FD_ISSET(dc->the_pty.fd, &readfds))
-			pty_activity(dc, s);
+		if (!exitby && FD_ISSET(dc->the_pty.fd, &readfds)
+		    && !pty_activity(dc))
+			ptyclosed(dc);
+		if (exitby && (waitpid(dc->the_pty.pid, 0, WNOHANG)
+			       || msnow() >= exitby))
+			endsession(dc);
+		reapifstale(dc);
 	}
 }
 
@@ -514,6 +748,8 @@ dtach_master(Dtachctx dc)
 		fprintf(stderr, "Socket path: %s\n", dc->sockpath);
 		return 1;
 	}
+	if (dc->runmark)
+		close(open(dc->runmark, O_WRONLY | O_CREAT | O_CLOEXEC, 0600));
 
 	/* Fork off so we can daemonize and such */
 	pid = fork();
@@ -521,6 +757,7 @@ dtach_master(Dtachctx dc)
 	{
 		perror("dtach: fork");
 		unlink(dc->sockpath);
+		if (dc->runmark) unlink(dc->runmark);
 		return 1;
 	}
 	else if (pid == 0)
@@ -15,6 +15,9 @@ void Xfinishdraw(TMint trm);
 void Xsetcolor(int trm, int pi, int rgb);
 void Xicontitl(TMint deq, TMint off);
 void Xsettitle(TMint deq, TMint off);
+/* Desktop notification from OSC 9 or 777. Either offset may be -1 if the
+   sequence did not include that part. */
+void Xnotify(TMint deq, TMint titoff, TMint bodoff);
 void Xsetpointermotion(int set);
 void Xximspot(TMint trm, int cx, int cy);
 void Xprint(TMint deq);
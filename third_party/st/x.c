@@ -2091,6 +2091,12 @@ xseturgency(int add)
 	XFree(h);
 }
 
+void
+Xnotify(TMint deq, TMint titoff, TMint bodoff)
+{
+	xseturgency(1);
+}
+
 void
 Xbell(TMint trm)
 {
@@ -0,0 +1,47 @@
+# Copyright 2023 Google LLC
+#
+# Use of this source code is governed by a BSD-style
+# license that can be found in the LICENSE file or at
+# https://developers.google.com/open-source/licenses/bsd
+
+# Functions shared by awk programs in CGI scripts. Run awk with LC_ALL=C so
+# bytes are not interpreted as multi-byte characters.
+
+# Decodes a query string argument.
+function urldec(s,	o, i, c)
+{
+	gsub(/\+/, " ", s)
+	o = ""
+	for (i = 1; i <= length(s); i++) {
+		c = substr(s, i, 1)
+		if (c == "%") {
+			c = sprintf("%c", 16 * hexval(substr(s, i+1, 1)) \
+					     + hexval(substr(s, i+2, 1)))
+			i += 2
+		}
+		o = o c
+	}
+	return o
+}
+
+function hexval(c) { return index("0123456789abcdef", tolower(c)) - 1 }
+
+# Formats s as a JSON string. Control characters other than tab are dropped.
+function json(s)
+{
+	gsub(/\\/, "\\\\", s)
+	gsub(/"/, "\\\"", s)
+	gsub(/\t/, "\\t", s)
+	gsub(/[\001-\037\177]/, "", s)
+	return "\"" s "\""
+}
+
+# Escapes s for use in HTML text or a quoted attribute value.
+function html(s)
+{
+	gsub(/&/, "\\&amp;", s)
+	gsub(/</, "\\&lt;", s)
+	gsub(/>/, "\\&gt;", s)
+	gsub(/"/, "\\&quot;", s)
+	return s
+}
@@ -14,3 +14,6 @@ dirname="$WERMVARDIR"/`date +%Y/%m`/hist
 mkdir -p "$dirname"
 HISTFILE="$dirname/$1"
 PROMPT_COMMAND="history -a;$PROMPT_COMMAND"
+
+# Save the time of each command so cgi/histsearch can report it.
+HISTTIMEFORMAT=${HISTTIMEFORMAT:-'%F %T '}
@@ -46,6 +46,8 @@ void dump_wts(void)
 	fprintf(f, "ttl: (sz=%u)\n", ttl_len());
 	fprintf(f, "allowtmstate: %u\n", wts.allowtmstate);
 	logescaped(f, wts.ttl, ttl_len());
+	fprintf(f, "osctitl:\n");
+	logescaped(f, wts.osctitl, strnlen(wts.osctitl, sizeof wts.osctitl));
 
 	fclose(f);
 }
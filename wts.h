@@ -4,6 +4,8 @@
  * license that can be found in the LICENSE file or at
  * https://developers.google.com/open-source/licenses/bsd */
 
+#include <time.h>
+
 /* Name is based on Write To Subproc but this contains process_kbd state too.
  * We put this in a single struct so all logic state can be reset with a single
  * memset call. */
@@ -16,17 +18,38 @@ typedef struct {
 
 	int t;
 
+	/* Signal to send to the foreground process group of the pty once the
+	   current keyboard input is written, or 0 if none. */
+	int sendsig;
+
+	/* Set if a client asked to end the session by hanging up the pty. */
+	unsigned hangup : 1;
+
 	/* 0: reading raw characters
 	 * '1': next char is escaped
 	 * 'w': reading window size
 	 * 't': reading title into ttl
 	 * 'i': reading endpoint ID int client_state's endpnt
+	 * 'g': reading a tag to set into tagarg
+	 * 'a': reading a tag filter for session state into tagarg
+	 * 'p': skipping a latency probe's argument
 	 */
 	char escp;
 
 	/* title set by client */
 	char ttl[128];
 
+	/* title set by the subprocess with an OSC 0 or 2 escape sequence */
+	char osctitl[128];
+
+	/* tags set by clients to organize sessions, in the form k=v&k2=v2 */
+	char tags[256];
+	char tagarg[64];
+
+	/* Latest round-trip time in ms measured with a client's latency probe,
+	   and the jitter in 1/16 ms. rttseen is set once there is one. */
+	unsigned rtt, jitter16;
+
 	unsigned allowtmstate	: 1;
 	unsigned sendsigwin	: 1;
 	unsigned writelg	: 1;
@@ -36,9 +59,30 @@ typedef struct {
 	   was populated automatically with line contents. */
 	unsigned clnttl		: 1;
 
+	/* echohint is set once a client asks to be told when the subprocess
+	   turns terminal echo on or off, e.g. for a password prompt. echoff is
+	   the last echo state sent to clients. */
+	unsigned echohint	: 1;
+	unsigned echoff		: 1;
+
+	/* Set when the subprocess rings the bell, and cleared when a client
+	   attaches to see why. */
+	unsigned bell		: 1;
+
+	unsigned rttseen	: 1;
+
 	/* Logs (either text only, or raw subproc output) are written to these
 	 * fd's if writelg,writerawlg are 1. */
 	struct wrides logde, rawlogde;
+
+	/* The asciicast recording is written here if writecast is 1. castt0 is
+	 * when it started, and casthold is the end of the last output if it
+	 * stopped in the middle of a UTF-8 character. */
+	struct wrides castde;
+	unsigned writecast	: 1;
+	struct timespec castt0;
+	char casthold[4];
+	unsigned castholdn;
 } Wts;
 
 extern Wts wts;